@@ -24,6 +24,7 @@ document.getElementById('login-form').addEventListener('submit', async (event) =
 async function createVideoDraft() {
   const title = document.getElementById('video-title').value;
   const description = document.getElementById('video-description').value;
+  const visibility = document.getElementById('video-visibility').value;
 
   try {
     const res = await fetch('/api/videos', {
@@ -32,7 +33,7 @@ async function createVideoDraft() {
         'Content-Type': 'application/json',
         Authorization: `Bearer ${localStorage.getItem('token')}`,
       },
-      body: JSON.stringify({ title, description }),
+      body: JSON.stringify({ title, description, visibility }),
     });
     const data = await res.json();
     if (!res.ok) {
@@ -176,7 +177,7 @@ async function uploadVideoFile(videoID) {
     }
 
     console.log('Video uploaded!');
-    await getVideo(videoID);
+    await waitForProcessing(videoID);
   } catch (error) {
     alert(`Error: ${error.message}`);
   }
@@ -184,6 +185,30 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(false, uploadBtnSelector);
 }
 
+// Videos are processed in the background after upload, poll until done
+async function waitForProcessing(videoID) {
+  for (;;) {
+    const res = await fetch(`/api/videos/${videoID}`, {
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+    if (!res.ok) {
+      throw new Error('Failed to get video.');
+    }
+
+    const video = await res.json();
+    if (video.status === 'failed') {
+      throw new Error('Video processing failed.');
+    }
+    if (video.status === 'ready') {
+      viewVideo(video);
+      return;
+    }
+    await new Promise((resolve) => setTimeout(resolve, 2000));
+  }
+}
+
 const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
@@ -255,6 +280,7 @@ function viewVideo(video) {
   document.getElementById('video-display').style.display = 'block';
   document.getElementById('video-title-display').textContent = video.title;
   document.getElementById('video-description-display').textContent = video.description;
+  document.getElementById('video-visibility-display').value = video.visibility;
 
   const thumbnailImg = document.getElementById('thumbnail-image');
   if (!video.thumbnail_url) {
@@ -262,6 +288,10 @@ function viewVideo(video) {
   } else {
     thumbnailImg.style.display = 'block';
     thumbnailImg.src = video.thumbnail_url;
+    // Let the browser pick a size from the generated variants
+    const variants = Object.values(video.thumbnails || {});
+    thumbnailImg.srcset = variants.map((v) => `${v.jpeg} ${v.width}w`).join(', ');
+    thumbnailImg.sizes = variants.length ? '(max-width: 640px) 100vw, 640px' : '';
   }
 
   const videoPlayer = document.getElementById('video-player');
@@ -276,6 +306,30 @@ function viewVideo(video) {
   }
 }
 
+async function updateVisibility(visibility) {
+  if (!currentVideo) {
+    return;
+  }
+
+  try {
+    const res = await fetch(`/api/videos/${currentVideo.id}`, {
+      method: 'PATCH',
+      headers: {
+        'Content-Type': 'application/json',
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+      body: JSON.stringify({ visibility }),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to update visibility. Error: ${data.error}`);
+    }
+    viewVideo(await res.json());
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
 async function deleteVideo() {
   if (!currentVideo) {
     alert('No video selected for deletion.');
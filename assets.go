@@ -1,7 +1,10 @@
 package main
 
 import (
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -10,3 +13,17 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	}
 	return nil
 }
+
+// assetPath returns the file in the assets directory behind an /assets/ URL,
+// as stored for thumbnails uploaded before they moved to the blob store.
+func (cfg apiConfig) assetPath(assetURL string) (string, bool) {
+	u, err := url.Parse(assetURL)
+	if err != nil || !strings.HasPrefix(u.Path, "/assets/") {
+		return "", false
+	}
+	name := strings.TrimPrefix(u.Path, "/assets/")
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", false
+	}
+	return filepath.Join(cfg.assetsRoot, name), true
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Requests authenticate with either an access JWT, "Authorization: Bearer
+// <jwt>", or an API key, "Authorization: ApiKey <key>". JWTs can do
+// anything their user can; API keys only what their scopes allow.
+//
+// Routes are wrapped in authMiddleware or optionalAuthMiddleware, which
+// authenticate once and put the user in the request context for
+// requestUser. Missing or invalid credentials are a 401, credentials that
+// aren't allowed to do something a 403.
+
+// apiKeyLastUsedResolution is how precisely the last use of an API key is
+// recorded.
+const apiKeyLastUsedResolution = time.Minute
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errMissingScope       = errors.New("API key doesn't have the required scope")
+)
+
+type contextKey int
+
+const userContextKey contextKey = iota
+
+// authenticate returns the user making the request. An empty scope only
+// accepts JWTs, for endpoints API keys mustn't reach at all. It returns
+// auth.ErrNoAuthHeaderIncluded for anonymous requests.
+func (cfg *apiConfig) authenticate(r *http.Request, scope string) (database.User, error) {
+	var userID uuid.UUID
+	var accessToken *auth.AccessToken
+	if key, err := auth.GetAPIKey(r.Header); err == nil {
+		userID, err = cfg.authenticateAPIKey(key, scope)
+		if err != nil {
+			return database.User{}, err
+		}
+	} else {
+		token, err := auth.GetBearerToken(r.Header)
+		if errors.Is(err, auth.ErrNoAuthHeaderIncluded) {
+			return database.User{}, err
+		}
+		if err != nil {
+			return database.User{}, fmt.Errorf("%w: %w", errInvalidCredentials, err)
+		}
+		validated, err := cfg.jwtKeys.ValidateJWT(token)
+		if err != nil {
+			return database.User{}, fmt.Errorf("%w: %w", errInvalidCredentials, err)
+		}
+		userID = validated.UserID
+		accessToken = &validated
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		return database.User{}, err
+	}
+	// Tokens outlive deleted users
+	if user == nil {
+		return database.User{}, fmt.Errorf("%w: user not found", errInvalidCredentials)
+	}
+	if accessToken != nil {
+		if err := cfg.checkAccessTokenSession(*accessToken, *user); err != nil {
+			return database.User{}, err
+		}
+	}
+	return *user, nil
+}
+
+// checkAccessTokenSession rejects access tokens whose session has ended.
+func (cfg *apiConfig) checkAccessTokenSession(accessToken auth.AccessToken, user database.User) error {
+	// Logging out everywhere moves the user to a new generation
+	if accessToken.Generation != user.TokenGeneration {
+		return fmt.Errorf("%w: token was issued before logging out everywhere", errInvalidCredentials)
+	}
+	// Tokens issued before sessions were tracked don't name one
+	if accessToken.SessionID == uuid.Nil {
+		return nil
+	}
+	active, err := cfg.db.SessionActive(accessToken.SessionID)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return fmt.Errorf("%w: session has been revoked", errInvalidCredentials)
+	}
+	return nil
+}
+
+func (cfg *apiConfig) authenticateAPIKey(key, scope string) (uuid.UUID, error) {
+	apiKey, err := cfg.db.GetAPIKeyByHash(auth.HashToken(key))
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if apiKey.ID == uuid.Nil || apiKey.RevokedAt != nil {
+		return uuid.Nil, fmt.Errorf("%w: unknown or revoked API key", errInvalidCredentials)
+	}
+	if scope == "" || !apiKey.HasScope(scope) {
+		return uuid.Nil, errMissingScope
+	}
+
+	// Failing to record the use shouldn't fail the request
+	err = cfg.db.TouchAPIKey(apiKey.ID, time.Now(), apiKeyLastUsedResolution)
+	if err != nil {
+		log.Printf("Couldn't record use of API key %s: %v", apiKey.ID, err)
+	}
+	return apiKey.UserID, nil
+}
+
+// authMiddleware only lets authenticated requests through. API keys need
+// scope, see authenticate.
+func (cfg *apiConfig) authMiddleware(scope string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := cfg.authenticate(r, scope)
+		if err != nil {
+			respondWithAuthError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	})
+}
+
+// optionalAuthMiddleware lets anonymous requests through as well. Requests
+// with credentials must still be valid.
+func (cfg *apiConfig) optionalAuthMiddleware(scope string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := cfg.authenticate(r, scope)
+		if errors.Is(err, auth.ErrNoAuthHeaderIncluded) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			respondWithAuthError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	})
+}
+
+func respondWithAuthError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, auth.ErrNoAuthHeaderIncluded):
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find credentials", err)
+	case errors.Is(err, errInvalidCredentials):
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate credentials", err)
+	case errors.Is(err, errMissingScope):
+		respondWithError(w, http.StatusForbidden, "API key doesn't allow this", err)
+	default:
+		respondWithError(w, http.StatusInternalServerError, "Couldn't authenticate request", err)
+	}
+}
+
+// requestUser returns the user the request was authenticated as, or a zero
+// User for anonymous requests.
+func requestUser(r *http.Request) database.User {
+	user, _ := r.Context().Value(userContextKey).(database.User)
+	return user
+}
+
+// getOwnedVideo loads the video in the path, making sure it belongs to the
+// authenticated user. Videos that don't exist are a 404, other users' videos
+// a 403. It writes the error response itself.
+func (cfg *apiConfig) getOwnedVideo(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return database.Video{}, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return database.Video{}, false
+	}
+	if video.UserID != requestUser(r).ID {
+		respondWithError(w, http.StatusForbidden, "You don't own this video", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
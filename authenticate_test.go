@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// newTestConfig returns a config backed by an in-memory SQLite database of
+// the test's own.
+func newTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+	db, err := database.NewClient(fmt.Sprintf("file:%s?mode=memory&cache=shared", uuid.NewString()))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &apiConfig{
+		db:      db,
+		jwtKeys: auth.NewHMACKeys("test-secret"),
+	}
+}
+
+func createTestUser(t *testing.T, cfg *apiConfig) (database.User, string) {
+	t.Helper()
+	user, err := cfg.db.CreateUser(database.CreateUserParams{
+		Email:    uuid.NewString() + "@example.com",
+		Password: "hash",
+	})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	token, err := cfg.jwtKeys.MakeJWT(auth.AccessToken{UserID: user.ID, Generation: user.TokenGeneration}, time.Hour)
+	if err != nil {
+		t.Fatalf("MakeJWT: %v", err)
+	}
+	return *user, token
+}
+
+// createTestAPIKey creates a key through the API, as the user holding jwt.
+func createTestAPIKey(t *testing.T, cfg *apiConfig, jwt string, scopes ...string) apiKeyResponse {
+	t.Helper()
+	body, err := json.Marshal(map[string]any{"name": "ci", "scopes": scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/api_keys", strings.NewReader(string(body)))
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	rec := httptest.NewRecorder()
+	cfg.authMiddleware("", cfg.handlerAPIKeyCreate).ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("creating API key: %d %s", rec.Code, rec.Body)
+	}
+
+	var key apiKeyResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &key); err != nil {
+		t.Fatalf("decoding API key: %v", err)
+	}
+	return key
+}
+
+func TestAPIKeysStoredHashed(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, jwt := createTestUser(t, cfg)
+
+	created := createTestAPIKey(t, cfg, jwt, auth.ScopeVideosRead)
+	if !strings.HasPrefix(created.Key, auth.APIKeyPrefix) {
+		t.Fatalf("key %q doesn't start with %q", created.Key, auth.APIKeyPrefix)
+	}
+
+	keys, err := cfg.db.GetAPIKeys(user.ID)
+	if err != nil {
+		t.Fatalf("GetAPIKeys: %v", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("user has %d keys, want 1", len(keys))
+	}
+	stored := keys[0]
+	if stored.KeyHash != auth.HashToken(created.Key) {
+		t.Errorf("stored hash %q, want the SHA-256 of the key", stored.KeyHash)
+	}
+	if stored.Prefix != created.Key[:apiKeyDisplayLength] {
+		t.Errorf("stored prefix %q, want %q", stored.Prefix, created.Key[:apiKeyDisplayLength])
+	}
+	if byKey, err := cfg.db.GetAPIKeyByHash(created.Key); err != nil || byKey.ID != uuid.Nil {
+		t.Errorf("key is stored as is: %v, %v", byKey.ID, err)
+	}
+
+	// Neither the key nor its hash is listed
+	req := httptest.NewRequest(http.MethodGet, "/api/api_keys", nil)
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	rec := httptest.NewRecorder()
+	cfg.authMiddleware("", cfg.handlerAPIKeysList).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("listing API keys: %d %s", rec.Code, rec.Body)
+	}
+	if body := rec.Body.String(); strings.Contains(body, created.Key) || strings.Contains(body, stored.KeyHash) {
+		t.Errorf("listed keys contain the key or its hash: %s", body)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, jwt := createTestUser(t, cfg)
+	readKey := createTestAPIKey(t, cfg, jwt, auth.ScopeVideosRead).Key
+	writeKey := createTestAPIKey(t, cfg, jwt, auth.ScopeVideosRead, auth.ScopeVideosWrite).Key
+	revoked := createTestAPIKey(t, cfg, jwt, auth.ScopeVideosRead, auth.ScopeVideosWrite)
+	if err := cfg.db.RevokeAPIKey(revoked.ID); err != nil {
+		t.Fatalf("RevokeAPIKey: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		scope         string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "anonymous", scope: auth.ScopeVideosRead, wantStatus: http.StatusUnauthorized},
+		{name: "JWT on a read route", scope: auth.ScopeVideosRead, authorization: "Bearer " + jwt, wantStatus: http.StatusOK},
+		{name: "JWT on a write route", scope: auth.ScopeVideosWrite, authorization: "Bearer " + jwt, wantStatus: http.StatusOK},
+		{name: "JWT on a JWT-only route", scope: "", authorization: "Bearer " + jwt, wantStatus: http.StatusOK},
+		{name: "invalid JWT", scope: auth.ScopeVideosRead, authorization: "Bearer " + jwt + "x", wantStatus: http.StatusUnauthorized},
+		{name: "read key on a read route", scope: auth.ScopeVideosRead, authorization: "ApiKey " + readKey, wantStatus: http.StatusOK},
+		{name: "read key on a write route", scope: auth.ScopeVideosWrite, authorization: "ApiKey " + readKey, wantStatus: http.StatusForbidden},
+		{name: "write key on a write route", scope: auth.ScopeVideosWrite, authorization: "ApiKey " + writeKey, wantStatus: http.StatusOK},
+		{name: "read key on a JWT-only route", scope: "", authorization: "ApiKey " + readKey, wantStatus: http.StatusForbidden},
+		{name: "write key on a JWT-only route", scope: "", authorization: "ApiKey " + writeKey, wantStatus: http.StatusForbidden},
+		{name: "revoked key", scope: auth.ScopeVideosRead, authorization: "ApiKey " + revoked.Key, wantStatus: http.StatusUnauthorized},
+		{name: "unknown key", scope: auth.ScopeVideosRead, authorization: "ApiKey " + auth.APIKeyPrefix + "unknown", wantStatus: http.StatusUnauthorized},
+		{name: "JWT sent as a key", scope: auth.ScopeVideosRead, authorization: "ApiKey " + jwt, wantStatus: http.StatusUnauthorized},
+		{name: "key sent as a JWT", scope: auth.ScopeVideosRead, authorization: "Bearer " + readKey, wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotUser database.User
+			handler := cfg.authMiddleware(tt.scope, func(w http.ResponseWriter, r *http.Request) {
+				gotUser = requestUser(r)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/api/videos", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusOK && gotUser.ID != user.ID {
+				t.Errorf("request user %v, want %v", gotUser.ID, user.ID)
+			}
+		})
+	}
+}
+
+func TestOptionalAuthMiddleware(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, jwt := createTestUser(t, cfg)
+	revoked := createTestAPIKey(t, cfg, jwt, auth.ScopeVideosRead)
+	if err := cfg.db.RevokeAPIKey(revoked.ID); err != nil {
+		t.Fatalf("RevokeAPIKey: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+		wantUser      uuid.UUID
+	}{
+		{name: "anonymous", wantStatus: http.StatusOK, wantUser: uuid.Nil},
+		{name: "JWT", authorization: "Bearer " + jwt, wantStatus: http.StatusOK, wantUser: user.ID},
+		// Bad credentials aren't downgraded to an anonymous request
+		{name: "revoked key", authorization: "ApiKey " + revoked.Key, wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotUser database.User
+			handler := cfg.optionalAuthMiddleware(auth.ScopeVideosRead, func(w http.ResponseWriter, r *http.Request) {
+				gotUser = requestUser(r)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/api/videos/"+uuid.NewString(), nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if gotUser.ID != tt.wantUser {
+				t.Errorf("request user %v, want %v", gotUser.ID, tt.wantUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+)
+
+// DASH is written by a single ffmpeg run: the ladder's video renditions and
+// one audio track share an MPD and are cut into CMAF fragmented MP4
+// segments.
+
+const dashManifest = "manifest.mpd"
+
+// transcodeDASH builds the DASH ladder for the video at filePath and uploads
+// it under prefix. It returns the key of the MPD.
+func (cfg *apiConfig) transcodeDASH(ctx context.Context, filePath string, width, height int, hasAudio bool, prefix string) (string, error) {
+	if width <= 0 || height <= 0 {
+		return "", fmt.Errorf("invalid video dimensions %dx%d", width, height)
+	}
+
+	outputDir, err := os.MkdirTemp("", "tubely-dash-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(outputDir)
+
+	renditions := videoRenditions(width, height)
+	args := []string{"-y", "-i", filePath}
+	for range renditions {
+		args = append(args, "-map", "0:v:0")
+	}
+	if hasAudio {
+		args = append(args, "-map", "0:a:0")
+	}
+
+	args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main")
+	for i, rendition := range renditions {
+		renditionWidth, renditionHeight := renditionSize(width, height, rendition.height)
+		args = append(args,
+			fmt.Sprintf("-filter:v:%d", i), fmt.Sprintf("scale=%d:%d", renditionWidth, renditionHeight),
+			fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", rendition.videoBitrate),
+			fmt.Sprintf("-maxrate:v:%d", i), fmt.Sprintf("%dk", rendition.videoBitrate*107/100),
+			fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprintf("%dk", rendition.videoBitrate*3/2),
+		)
+	}
+	args = append(args,
+		// Keyframes on segment boundaries so every segment starts clean
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentSeconds),
+		"-sc_threshold", "0",
+	)
+
+	adaptationSets := "id=0,streams=v"
+	if hasAudio {
+		// The best audio of the ladder, players switch video renditions only
+		args = append(args, "-c:a", "aac", "-ac", "2", "-b:a", fmt.Sprintf("%dk", renditions[0].audioBitrate))
+		adaptationSets += " id=1,streams=a"
+	}
+
+	args = append(args,
+		"-f", "dash",
+		"-dash_segment_type", "mp4",
+		"-seg_duration", fmt.Sprint(segmentSeconds),
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-adaptation_sets", adaptationSets,
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		filepath.Join(outputDir, dashManifest),
+	)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("ffmpeg dash: %w: %s", err, lastLines(output, 5))
+	}
+
+	if err := cfg.uploadDir(ctx, outputDir, prefix, streamContentTypes); err != nil {
+		return "", err
+	}
+	return path.Join(prefix, dashManifest), nil
+}
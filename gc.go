@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The garbage collector finds blobs and asset files no row points to any
+// more, left behind by uploads that failed before the database was updated
+// or by deletes from before deletion cleaned up storage. Objects younger
+// than the grace period are never deleted, as an upload writes its blobs
+// before the row that references them.
+
+const (
+	gcUsage              = "usage: tubely gc [-dry-run] [-grace duration]"
+	gcDefaultGracePeriod = 24 * time.Hour
+)
+
+type gcOptions struct {
+	GracePeriod time.Duration
+	DryRun      bool
+}
+
+type gcOrphan struct {
+	// Asset is set for files in the assets directory, Key is then the file
+	// name
+	Asset        bool
+	Key          string
+	Size         int64
+	LastModified time.Time
+	// Status says what happened to the orphan, one of the gcStatus values
+	Status string
+}
+
+const (
+	gcStatusDeleted      = "deleted"
+	gcStatusDryRun       = "dry run"
+	gcStatusGracePeriod  = "in grace period"
+	gcStatusDeleteFailed = "delete failed"
+)
+
+type gcReport struct {
+	Orphans      []gcOrphan
+	OrphanBytes  int64
+	DeletedBytes int64
+}
+
+// gcReferences is the set of keys and asset files the database points to.
+type gcReferences struct {
+	keys     map[string]bool
+	prefixes []string
+	assets   map[string]bool
+}
+
+func (refs gcReferences) hasKey(key string) bool {
+	if refs.keys[key] {
+		return true
+	}
+	for _, prefix := range refs.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *apiConfig) gcReferences() (gcReferences, error) {
+	refs := gcReferences{
+		keys:   map[string]bool{},
+		assets: map[string]bool{},
+	}
+
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return refs, err
+	}
+	for _, video := range videos {
+		if video.VideoURL != nil && *video.VideoURL != "" {
+			refs.keys[videoStorageKey(*video.VideoURL)] = true
+		}
+		for _, format := range []string{"hls", "dash"} {
+			if prefix, _, ok := streamBaseKey(video, format); ok {
+				refs.prefixes = append(refs.prefixes, prefix+"/")
+			}
+		}
+		for _, variant := range video.Thumbnails {
+			refs.keys[variant.JPEG] = true
+			refs.keys[variant.WebP] = true
+		}
+		if video.ThumbnailURL != nil {
+			if file, ok := cfg.assetPath(*video.ThumbnailURL); ok {
+				refs.assets[filepath.Base(file)] = true
+			} else {
+				refs.keys[*video.ThumbnailURL] = true
+			}
+		}
+		refs.prefixes = append(refs.prefixes, thumbnailCandidatesPrefix(video.ID))
+	}
+
+	// Earlier versions can be restored, keep their files
+	versions, err := cfg.db.GetAllVideoVersions()
+	if err != nil {
+		return refs, err
+	}
+	for _, version := range versions {
+		file := videoFileBlobs(versionVideo(version))
+		for _, key := range file.Keys {
+			refs.keys[key] = true
+		}
+		refs.prefixes = append(refs.prefixes, file.Prefixes...)
+	}
+
+	uploads, err := cfg.db.GetAllVideoUploads()
+	if err != nil {
+		return refs, err
+	}
+	for _, upload := range uploads {
+		refs.prefixes = append(refs.prefixes, tusChunkPrefix(upload.ID))
+	}
+
+	jobs, err := cfg.db.GetUnfinishedJobs(jobTypeProcessVideo)
+	if err != nil {
+		return refs, err
+	}
+	for _, job := range jobs {
+		var payload processVideoPayload
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return refs, fmt.Errorf("couldn't decode payload of job %s: %w", job.ID, err)
+		}
+		refs.keys[payload.SourceKey] = true
+	}
+
+	return refs, nil
+}
+
+// collectGarbage reports blobs and asset files nothing references and
+// deletes those older than the grace period, unless it's a dry run.
+func (cfg *apiConfig) collectGarbage(ctx context.Context, opts gcOptions) (gcReport, error) {
+	report := gcReport{Orphans: []gcOrphan{}}
+
+	// List before loading the references, so anything referenced by the
+	// time the listing is done is kept
+	objects, err := cfg.store.List(ctx, "")
+	if err != nil {
+		return report, fmt.Errorf("couldn't list blobs: %w", err)
+	}
+	assets, err := os.ReadDir(cfg.assetsRoot)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return report, fmt.Errorf("couldn't list assets: %w", err)
+	}
+
+	refs, err := cfg.gcReferences()
+	if err != nil {
+		return report, err
+	}
+
+	for _, object := range objects {
+		if refs.hasKey(object.Key) {
+			continue
+		}
+		report.Orphans = append(report.Orphans, gcOrphan{
+			Key:          object.Key,
+			Size:         object.Size,
+			LastModified: object.LastModified,
+		})
+	}
+	for _, entry := range assets {
+		if entry.IsDir() || refs.assets[entry.Name()] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		report.Orphans = append(report.Orphans, gcOrphan{
+			Asset:        true,
+			Key:          entry.Name(),
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+	}
+
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	// A direct upload is only referenced once the client completes it,
+	// which it may do for as long as its presigned URL is valid. Uploads
+	// never completed are orphans after that.
+	directUploadCutoff := cutoff.Add(-directUploadExpiry)
+	for i := range report.Orphans {
+		orphan := &report.Orphans[i]
+		report.OrphanBytes += orphan.Size
+		if opts.DryRun {
+			orphan.Status = gcStatusDryRun
+			continue
+		}
+		orphanCutoff := cutoff
+		if !orphan.Asset && strings.HasPrefix(orphan.Key, directUploadRoot) {
+			orphanCutoff = directUploadCutoff
+		}
+		if orphan.LastModified.After(orphanCutoff) {
+			orphan.Status = gcStatusGracePeriod
+			continue
+		}
+
+		var err error
+		if orphan.Asset {
+			err = os.Remove(filepath.Join(cfg.assetsRoot, orphan.Key))
+			if errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		} else {
+			err = cfg.store.Delete(ctx, orphan.Key)
+		}
+		if err != nil {
+			log.Printf("Couldn't delete orphan %s: %v", orphan.Key, err)
+			orphan.Status = gcStatusDeleteFailed
+			continue
+		}
+		orphan.Status = gcStatusDeleted
+		report.DeletedBytes += orphan.Size
+	}
+
+	return report, nil
+}
+
+// collectGarbagePeriodically runs the garbage collector in the background
+// and logs what it found.
+func (cfg *apiConfig) collectGarbagePeriodically(ctx context.Context, interval time.Duration, opts gcOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := cfg.collectGarbage(ctx, opts)
+		if err != nil {
+			log.Printf("Garbage collection failed: %v", err)
+			continue
+		}
+		deleted := 0
+		for _, orphan := range report.Orphans {
+			if orphan.Status == gcStatusDeleted {
+				deleted++
+			}
+		}
+		if len(report.Orphans) > 0 {
+			log.Printf("Garbage collection found %d orphans (%s), deleted %d (%s)",
+				len(report.Orphans), formatBytes(report.OrphanBytes), deleted, formatBytes(report.DeletedBytes))
+		}
+	}
+}
+
+func runGC(cfg *apiConfig, args []string) error {
+	_, envOpts, err := gcOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report orphans without deleting them")
+	grace := flags.Duration("grace", envOpts.GracePeriod, "only delete orphans older than this")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w\n%s", err, gcUsage)
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q\n%s", flags.Arg(0), gcUsage)
+	}
+
+	report, err := cfg.collectGarbage(context.Background(), gcOptions{
+		GracePeriod: *grace,
+		DryRun:      *dryRun,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, orphan := range report.Orphans {
+		location := "blob"
+		if orphan.Asset {
+			location = "asset"
+		}
+		fmt.Printf("%-5s  %10s  %s  %-15s  %s\n",
+			location,
+			formatBytes(orphan.Size),
+			orphan.LastModified.UTC().Format("2006-01-02 15:04:05"),
+			orphan.Status,
+			orphan.Key,
+		)
+	}
+	fmt.Printf("%d orphans, %s; deleted %s\n", len(report.Orphans), formatBytes(report.OrphanBytes), formatBytes(report.DeletedBytes))
+	return nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// gcOptionsFromEnv reads the settings of the periodic garbage collector.
+// It returns a zero interval when GC_INTERVAL isn't set.
+func gcOptionsFromEnv() (time.Duration, gcOptions, error) {
+	opts := gcOptions{
+		GracePeriod: gcDefaultGracePeriod,
+		DryRun:      os.Getenv("GC_DRY_RUN") == "true",
+	}
+	if grace := os.Getenv("GC_GRACE_PERIOD"); grace != "" {
+		d, err := time.ParseDuration(grace)
+		if err != nil {
+			return 0, opts, fmt.Errorf("GC_GRACE_PERIOD must be a duration: %w", err)
+		}
+		opts.GracePeriod = d
+	}
+
+	interval := os.Getenv("GC_INTERVAL")
+	if interval == "" {
+		return 0, opts, nil
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil || d <= 0 {
+		return 0, opts, fmt.Errorf("GC_INTERVAL must be a positive duration: %q", interval)
+	}
+	return d, opts, nil
+}
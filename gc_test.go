@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+func TestCollectGarbageDirectUploads(t *testing.T) {
+	cfg := newTestConfig(t)
+	root := t.TempDir()
+	store, err := storage.NewLocalStore(root, "http://localhost:8091/blobs", []byte("test-secret"), maxVideoUploadSize)
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	cfg.store = store
+	cfg.assetsRoot = t.TempDir()
+
+	user, _ := createTestUser(t, cfg)
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	prefix := directUploadPrefix(video.ID)
+	now := time.Now()
+	grace := time.Hour
+
+	objects := []struct {
+		name       string
+		key        string
+		age        time.Duration
+		completed  bool
+		wantStatus string
+	}{
+		{
+			name:       "completed upload waiting for its job",
+			key:        prefix + "completed.mp4",
+			age:        2 * time.Hour,
+			completed:  true,
+			wantStatus: "",
+		},
+		{
+			name:       "upload that may still be completed",
+			key:        prefix + "recent.mp4",
+			age:        grace + directUploadExpiry/2,
+			wantStatus: gcStatusGracePeriod,
+		},
+		{
+			name:       "upload never completed",
+			key:        prefix + "abandoned.mp4",
+			age:        grace + 2*directUploadExpiry,
+			wantStatus: gcStatusDeleted,
+		},
+		{
+			name:       "other orphan past the grace period",
+			key:        "landscape/stray.mp4",
+			age:        grace + directUploadExpiry/2,
+			wantStatus: gcStatusDeleted,
+		},
+	}
+	for _, object := range objects {
+		if err := store.Put(context.Background(), object.key, strings.NewReader("video"), "video/mp4"); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		modified := now.Add(-object.age)
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(object.key)), modified, modified); err != nil {
+			t.Fatal(err)
+		}
+		if object.completed {
+			if _, err := cfg.queueVideoProcessing(video.ID, object.key, "video/mp4"); err != nil {
+				t.Fatalf("queueVideoProcessing: %v", err)
+			}
+		}
+	}
+
+	report, err := cfg.collectGarbage(context.Background(), gcOptions{GracePeriod: grace})
+	if err != nil {
+		t.Fatalf("collectGarbage: %v", err)
+	}
+	statuses := map[string]string{}
+	for _, orphan := range report.Orphans {
+		statuses[orphan.Key] = orphan.Status
+	}
+
+	for _, object := range objects {
+		if got := statuses[object.key]; got != object.wantStatus {
+			t.Errorf("%s: status %q, want %q", object.name, got, object.wantStatus)
+		}
+		_, err := store.Head(context.Background(), object.key)
+		if exists := err == nil; exists == (object.wantStatus == gcStatusDeleted) {
+			t.Errorf("%s: exists = %v after collecting (%v)", object.name, exists, err)
+		}
+	}
+}
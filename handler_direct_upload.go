@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// Direct uploads let the browser send the video straight to the blob store
+// with a presigned request. The API only sees the "complete" call, after
+// which a worker pulls the object down for fast start processing.
+
+const directUploadExpiry = 15 * time.Minute
+
+// directUploadRoot holds the direct uploads of every video.
+const directUploadRoot = "uploads/direct/"
+
+func directUploadPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("%s%s/", directUploadRoot, videoID)
+}
+
+func (cfg *apiConfig) handlerDirectUploadPresign(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+		Method      string `json:"method"`
+	}
+	type response struct {
+		Key       string                 `json:"key"`
+		Method    string                 `json:"method"`
+		URL       string                 `json:"url"`
+		Headers   map[string]string      `json:"headers,omitempty"`
+		Post      *storage.PresignedPost `json:"post,omitempty"`
+		ExpiresAt time.Time              `json:"expires_at"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	presigner, ok := cfg.store.(storage.UploadPresigner)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads aren't supported by this storage backend", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	extension, err := getVideoExtension(params.ContentType)
+	if err != nil {
+		respondWithError(w, http.StatusNotAcceptable, "Not acceptable", err)
+		return
+	}
+	if params.Size <= 0 || params.Size > maxVideoUploadSize {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Size must be between 1 and %d bytes", int64(maxVideoUploadSize)), nil)
+		return
+	}
+
+	name, err := randomHex(16)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error generating random bytes", err)
+		return
+	}
+	key := fmt.Sprintf("%s%s.%s", directUploadPrefix(video.ID), name, extension)
+
+	resp := response{
+		Key:       key,
+		ExpiresAt: time.Now().Add(directUploadExpiry).UTC(),
+	}
+
+	switch params.Method {
+	case "", http.MethodPut:
+		url, err := presigner.PresignPut(r.Context(), key, params.ContentType, directUploadExpiry)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+			return
+		}
+		resp.Method = http.MethodPut
+		resp.URL = url
+		resp.Headers = map[string]string{"Content-Type": params.ContentType}
+	case http.MethodPost:
+		post, err := presigner.PresignPost(r.Context(), key, params.ContentType, params.Size, directUploadExpiry)
+		if errors.Is(err, storage.ErrUnsupported) {
+			respondWithError(w, http.StatusNotImplemented, "POST uploads aren't supported by this storage backend", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+			return
+		}
+		resp.Method = http.MethodPost
+		resp.URL = post.URL
+		resp.Post = &post
+	default:
+		respondWithError(w, http.StatusBadRequest, "Method must be PUT or POST", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerDirectUploadComplete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key string `json:"key"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	// Only accept keys we handed out for this video
+	if !strings.HasPrefix(params.Key, directUploadPrefix(video.ID)) || path.Clean(params.Key) != params.Key {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload key", nil)
+		return
+	}
+
+	// Completing an upload again, say after a timeout, mustn't process it
+	// twice: the first job consumes the upload
+	job, err := cfg.db.GetJobByDedupeKey(params.Key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check upload", err)
+		return
+	}
+	if job.ID != uuid.Nil {
+		signedVideo, err := cfg.dbVideoToSignedVideo(video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error generating signed video", err)
+			return
+		}
+		respondWithJSON(w, http.StatusAccepted, signedVideo)
+		return
+	}
+
+	info, err := cfg.store.Head(r.Context(), params.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Upload not found, did the upload finish?", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check upload", err)
+		return
+	}
+	if info.Size <= 0 || info.Size > maxVideoUploadSize {
+		cfg.store.Delete(r.Context(), params.Key)
+		respondWithError(w, http.StatusBadRequest, "Uploaded file has an invalid size", nil)
+		return
+	}
+
+	contentType := info.ContentType
+	extension, err := getVideoExtension(contentType)
+	if err != nil || extension != strings.TrimPrefix(path.Ext(params.Key), ".") {
+		cfg.store.Delete(r.Context(), params.Key)
+		respondWithError(w, http.StatusNotAcceptable, "Not acceptable", err)
+		return
+	}
+
+	video, err = cfg.queueVideoProcessing(video.ID, params.Key, contentType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error queueing video for processing", err)
+		return
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error generating signed video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, signedVideo)
+}
+
+// downloadBlob copies an object into a temp file and returns its path. The
+// caller removes the file.
+func (cfg *apiConfig) downloadBlob(ctx context.Context, key string) (string, error) {
+	body, _, err := cfg.store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	f, err := os.CreateTemp("", "tubely-*"+path.Ext(key))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, body); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -1,12 +1,54 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 	"github.com/google/uuid"
 )
 
+// thumbnailPath is the canonical URL of a video's thumbnail. It stays the
+// same when the thumbnail is replaced, clients revalidate with the ETag.
+func thumbnailPath(videoID uuid.UUID) string {
+	return fmt.Sprintf("/api/thumbnails/%s", videoID)
+}
+
+func thumbnailVariantPath(videoID uuid.UUID, width int, format string) string {
+	return fmt.Sprintf("%s?width=%d&format=%s", thumbnailPath(videoID), width, format)
+}
+
+// thumbnailKey picks the blob store key for a thumbnail request. An empty
+// width asks for the default size.
+func thumbnailKey(video database.Video, width, format string) (string, bool) {
+	if width == "" {
+		if format == "jpeg" {
+			return *video.ThumbnailURL, true
+		}
+		for _, variant := range video.Thumbnails {
+			if variant.JPEG == *video.ThumbnailURL {
+				return variant.WebP, true
+			}
+		}
+		return "", false
+	}
+
+	variant, ok := video.Thumbnails[width]
+	if !ok {
+		return "", false
+	}
+	if format == "webp" {
+		return variant.WebP, true
+	}
+	return variant.JPEG, true
+}
+
 func (cfg *apiConfig) handlerThumbnailGet(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -15,18 +57,100 @@ func (cfg *apiConfig) handlerThumbnailGet(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	tn, ok := videoThumbnails[videoID]
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "jpeg"
+	}
+	if format != "jpeg" && format != "webp" {
+		respondWithError(w, http.StatusBadRequest, "Format must be jpeg or webp", nil)
+		return
+	}
+	width := r.URL.Query().Get("width")
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.ThumbnailURL == nil {
+		respondWithError(w, http.StatusNotFound, "Thumbnail not found", nil)
+		return
+	}
+
+	// Private thumbnails need a signed URL or the owner's token
+	if !canViewVideo(video, requestUser(r).ID) && !cfg.validThumbnailSignature(r, videoID) {
+		respondWithError(w, http.StatusNotFound, "Thumbnail not found", nil)
+		return
+	}
+
+	// Thumbnails uploaded before they moved to the blob store live in the
+	// assets directory
+	if isAbsoluteURL(*video.ThumbnailURL) {
+		http.Redirect(w, r, *video.ThumbnailURL, http.StatusFound)
+		return
+	}
+
+	key, ok := thumbnailKey(video, width, format)
 	if !ok {
 		respondWithError(w, http.StatusNotFound, "Thumbnail not found", nil)
 		return
 	}
 
-	w.Header().Set("Content-Type", tn.mediaType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(tn.data)))
+	info, err := cfg.store.Head(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Thumbnail not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail", err)
+		return
+	}
 
-	_, err = w.Write(tn.data)
+	etag := strconv.Quote(info.ETag)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	if video.Visibility == database.VisibilityPrivate {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if thumbnailNotModified(r, etag, info.LastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body, info, err := cfg.store.Get(r.Context(), key)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error writing response", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail", err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
 		return
 	}
+	io.Copy(w, body)
+}
+
+// thumbnailNotModified evaluates If-None-Match, falling back to
+// If-Modified-Since when the client sent no ETag.
+func thumbnailNotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(since)
 }
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+// handlerJWKS publishes the public keys access tokens are signed with, for
+// other services to verify them. It's empty when tokens are signed with
+// HS256.
+func (cfg *apiConfig) handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Keys []auth.JWK `json:"keys"`
+	}
+
+	// Keys are published before they become active, so a short cache is
+	// enough for verifiers to see a new key in time
+	w.Header().Set("Cache-Control", "public, max-age=900")
+	respondWithJSON(w, http.StatusOK, response{
+		Keys: cfg.jwtKeys.JWKS(),
+	})
+}
@@ -1,15 +1,37 @@
 package main
 
 import (
+	"errors"
+	"log"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 )
 
+// refreshTokenExpiry is how long a refresh token lasts. Every refresh
+// issues a new one, so sessions in use don't expire.
+const refreshTokenExpiry = 60 * 24 * time.Hour
+
+// clientIP returns the address the request came from, without the port. It
+// doesn't trust X-Forwarded-For, which clients can set to anything.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// handlerRefresh exchanges a refresh token for an access JWT and a new
+// refresh token. The old refresh token can't be used again: presenting it
+// once more means it was stolen, and revokes the new one as well.
 func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
 	refreshToken, err := auth.GetBearerToken(r.Header)
@@ -18,24 +40,56 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := cfg.db.GetUserByRefreshToken(refreshToken)
+	nextToken, err := auth.MakeRefreshToken()
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
+		return
+	}
+
+	now := time.Now()
+	rt, err := cfg.db.RotateRefreshToken(refreshToken, database.CreateRefreshTokenParams{
+		Token:     nextToken,
+		ExpiresAt: now.Add(refreshTokenExpiry),
+		UserAgent: r.UserAgent(),
+		IPAddress: clientIP(r),
+	}, now)
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		log.Printf("Refresh token reused from %s, revoked its family", clientIP(r))
+		respondWithError(w, http.StatusUnauthorized, "Refresh token has already been used", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't refresh token", err)
+		return
+	}
+	if rt.Token == "" {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token is invalid, revoked or expired", nil)
+		return
+	}
+
+	user, err := cfg.db.GetUser(rt.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusUnauthorized, "User not found", nil)
 		return
 	}
 
-	accessToken, err := auth.MakeJWT(
-		user.ID,
-		cfg.jwtSecret,
-		time.Hour,
-	)
+	accessToken, err := cfg.jwtKeys.MakeJWT(auth.AccessToken{
+		UserID:     user.ID,
+		Generation: user.TokenGeneration,
+		SessionID:  rt.FamilyID,
+	}, time.Hour)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, response{
-		Token: accessToken,
+		Token:        accessToken,
+		RefreshToken: rt.Token,
 	})
 }
 
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Share links let someone without an account view a single video, whatever
+// its visibility. The token is only shown when the link is created.
+
+const (
+	shareLinkDefaultExpiry = 7 * 24 * time.Hour
+	shareLinkMaxExpiry     = 90 * 24 * time.Hour
+)
+
+// shareLinkPasswordHeader carries the password of a protected share link. A
+// header keeps it out of URLs and access logs.
+const shareLinkPasswordHeader = "X-Share-Password"
+
+// Wrong passwords lock a link for a while once there have been
+// shareLinkFreePasswordAttempts in a row, doubling with every further one up
+// to shareLinkMaxPasswordLockout. The lock is per link, so it holds however
+// many addresses the guesses come from.
+const (
+	shareLinkFreePasswordAttempts = 5
+	shareLinkMaxPasswordLockout   = 15 * time.Minute
+)
+
+// shareLinkPasswordLockout is how long a link is locked after the given
+// number of wrong passwords in a row.
+func shareLinkPasswordLockout(attempts int) time.Duration {
+	if attempts < shareLinkFreePasswordAttempts {
+		return 0
+	}
+	lockout := time.Second
+	for i := shareLinkFreePasswordAttempts; i < attempts && lockout < shareLinkMaxPasswordLockout; i++ {
+		lockout *= 2
+	}
+	return min(lockout, shareLinkMaxPasswordLockout)
+}
+
+type shareLinkResponse struct {
+	database.ShareLink
+	HasPassword bool `json:"has_password"`
+	// Token and URL are only set in the response creating the link
+	Token string `json:"token,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+func newShareLinkResponse(link database.ShareLink) shareLinkResponse {
+	return shareLinkResponse{
+		ShareLink:   link,
+		HasPassword: link.Password != nil,
+	}
+}
+
+func sharePath(token string) string {
+	return "/api/share/" + token
+}
+
+func (cfg *apiConfig) handlerShareLinkCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ExpiresInSeconds int     `json:"expires_in_seconds"`
+		MaxViews         *int    `json:"max_views"`
+		Password         *string `json:"password"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	expiresIn := shareLinkDefaultExpiry
+	if params.ExpiresInSeconds != 0 {
+		expiresIn = time.Duration(params.ExpiresInSeconds) * time.Second
+	}
+	if expiresIn <= 0 || expiresIn > shareLinkMaxExpiry {
+		respondWithError(w, http.StatusBadRequest, "Share links must expire within 90 days", nil)
+		return
+	}
+	if params.MaxViews != nil && *params.MaxViews < 1 {
+		respondWithError(w, http.StatusBadRequest, "max_views must be at least 1", nil)
+		return
+	}
+
+	var password *string
+	if params.Password != nil && *params.Password != "" {
+		hash, err := auth.HashPassword(*params.Password)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
+			return
+		}
+		password = &hash
+	}
+
+	token, err := auth.MakeToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create token", err)
+		return
+	}
+
+	link, err := cfg.db.CreateShareLink(database.CreateShareLinkParams{
+		VideoID:   video.ID,
+		UserID:    video.UserID,
+		TokenHash: auth.HashToken(token),
+		Password:  password,
+		ExpiresAt: time.Now().Add(expiresIn),
+		MaxViews:  params.MaxViews,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create share link", err)
+		return
+	}
+
+	resp := newShareLinkResponse(link)
+	resp.Token = token
+	resp.URL = sharePath(token)
+	respondWithJSON(w, http.StatusCreated, resp)
+}
+
+func (cfg *apiConfig) handlerShareLinksList(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	links, err := cfg.db.GetShareLinks(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve share links", err)
+		return
+	}
+
+	resp := []shareLinkResponse{}
+	for _, link := range links {
+		resp = append(resp, newShareLinkResponse(link))
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerShareLinkRevoke(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	linkID, err := uuid.Parse(r.PathValue("shareLinkID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid share link ID", err)
+		return
+	}
+	link, err := cfg.db.GetShareLink(linkID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get share link", err)
+		return
+	}
+	if link.ID == uuid.Nil || link.VideoID != video.ID {
+		respondWithError(w, http.StatusNotFound, "Share link not found", nil)
+		return
+	}
+
+	err = cfg.db.RevokeShareLink(link.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke share link", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerShareGet returns the video of a share link with freshly signed
+// URLs. Every successful request counts as a view.
+func (cfg *apiConfig) handlerShareGet(w http.ResponseWriter, r *http.Request) {
+	link, err := cfg.db.GetShareLinkByTokenHash(auth.HashToken(r.PathValue("token")))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get share link", err)
+		return
+	}
+	if link.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Share link not found", nil)
+		return
+	}
+
+	now := time.Now()
+	if link.RevokedAt != nil {
+		respondWithError(w, http.StatusGone, "Share link has been revoked", nil)
+		return
+	}
+	if !now.Before(link.ExpiresAt) {
+		respondWithError(w, http.StatusGone, "Share link has expired", nil)
+		return
+	}
+
+	if link.Password != nil {
+		password := r.Header.Get(shareLinkPasswordHeader)
+		if password == "" {
+			respondWithError(w, http.StatusUnauthorized, "Share link requires a password", nil)
+			return
+		}
+		if link.PasswordLockedUntil != nil && now.Before(*link.PasswordLockedUntil) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(link.PasswordLockedUntil.Sub(now).Seconds()))))
+			respondWithError(w, http.StatusTooManyRequests, "Too many incorrect passwords, try again later", nil)
+			return
+		}
+		// The attempt is counted before the password is checked, and only
+		// if no other was counted meanwhile, so parallel guesses don't get
+		// past the lock
+		var lockedUntil *time.Time
+		if lockout := shareLinkPasswordLockout(link.FailedPasswordAttempts + 1); lockout > 0 {
+			until := now.Add(lockout)
+			lockedUntil = &until
+		}
+		claimed, err := cfg.db.ClaimShareLinkPasswordAttempt(link, lockedUntil, now)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't record password attempt", err)
+			return
+		}
+		if !claimed {
+			w.Header().Set("Retry-After", "1")
+			respondWithError(w, http.StatusTooManyRequests, "Too many password attempts, try again later", nil)
+			return
+		}
+		if err := auth.CheckPasswordHash(password, *link.Password); err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Incorrect password", nil)
+			return
+		}
+		if err := cfg.db.ResetShareLinkPasswordFailures(link.ID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't reset failed attempts", err)
+			return
+		}
+	}
+
+	ok, err := cfg.db.RecordShareLinkView(link.ID, now)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record view", err)
+		return
+	}
+	// Out of views, or revoked or expired since it was loaded
+	if !ok {
+		respondWithError(w, http.StatusGone, "Share link is no longer valid", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(link.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error generating signed video", err)
+		return
+	}
+
+	err = cfg.setStreamCookies(w, video, &signedVideo)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error signing stream cookies", err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestShareGetParallelPasswordGuesses(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg)
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	password, err := auth.HashPassword("right")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const token = "share-token"
+	if _, err := cfg.db.CreateShareLink(database.CreateShareLinkParams{
+		VideoID:   video.ID,
+		UserID:    user.ID,
+		TokenHash: auth.HashToken(token),
+		Password:  &password,
+		ExpiresAt: time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatalf("CreateShareLink: %v", err)
+	}
+
+	const guesses = 20
+	statuses := make(chan int, guesses)
+	var wg sync.WaitGroup
+	for range guesses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/api/share/"+token, nil)
+			req.SetPathValue("token", token)
+			req.Header.Set(shareLinkPasswordHeader, "wrong")
+			rec := httptest.NewRecorder()
+			cfg.handlerShareGet(rec, req)
+			statuses <- rec.Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	// Guesses the lock refuses mustn't have their password checked
+	checked := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusUnauthorized:
+			checked++
+		case http.StatusTooManyRequests:
+		default:
+			t.Errorf("guess answered %d", status)
+		}
+	}
+	if checked > shareLinkFreePasswordAttempts {
+		t.Errorf("%d of %d parallel guesses were checked, want at most %d", checked, guesses, shareLinkFreePasswordAttempts)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// Streaming playlists reference their segments with relative URIs, which a
+// presigned URL per object can't satisfy. Instead the signature lives in the
+// path of a stream URL, so relative URIs resolve to URLs that carry it too.
+// Playlists are served through the API and segments redirect to a presigned
+// URL for the object.
+
+const (
+	streamURLExpiry  = 6 * time.Hour
+	segmentURLExpiry = 15 * time.Minute
+)
+
+// streamBaseKey returns the blob store prefix holding the files of a stream
+// format and the name of its entry point.
+func streamBaseKey(video database.Video, format string) (string, string, bool) {
+	switch format {
+	case "hls":
+		if video.HLSURL == nil || *video.HLSURL == "" {
+			return "", "", false
+		}
+		return path.Dir(*video.HLSURL), path.Base(*video.HLSURL), true
+	case "dash":
+		if video.DASHURL == nil || *video.DASHURL == "" {
+			return "", "", false
+		}
+		return path.Dir(*video.DASHURL), path.Base(*video.DASHURL), true
+	}
+	return "", "", false
+}
+
+func (cfg *apiConfig) streamSignature(videoID uuid.UUID, format string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(cfg.jwtSecret))
+	fmt.Fprintf(mac, "%s\n%s\n%d", videoID, format, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedStreamURL returns a URL for the entry point of the video's stream in
+// the given format, or nil if the video has none.
+func (cfg *apiConfig) signedStreamURL(video database.Video, format string) *string {
+	_, entry, ok := streamBaseKey(video, format)
+	if !ok {
+		return nil
+	}
+	expires := time.Now().Add(streamURLExpiry).Unix()
+	url := fmt.Sprintf("/api/videos/%s/stream/%s/%d/%s/%s",
+		video.ID,
+		format,
+		expires,
+		cfg.streamSignature(video.ID, format, expires),
+		entry,
+	)
+	return &url
+}
+
+func (cfg *apiConfig) handlerStreamGet(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	format := r.PathValue("format")
+
+	expires, err := strconv.ParseInt(r.PathValue("expires"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid expiry", err)
+		return
+	}
+	signature := cfg.streamSignature(videoID, format, expires)
+	if !hmac.Equal([]byte(signature), []byte(r.PathValue("signature"))) {
+		respondWithError(w, http.StatusForbidden, "Invalid signature", nil)
+		return
+	}
+	if time.Now().Unix() > expires {
+		respondWithError(w, http.StatusForbidden, "Stream URL has expired", nil)
+		return
+	}
+
+	file := r.PathValue("file")
+	if file == "" || path.Clean(file) != file || strings.HasPrefix(file, "../") || strings.HasPrefix(file, "/") {
+		respondWithError(w, http.StatusBadRequest, "Invalid file", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	baseKey, _, ok := streamBaseKey(video, format)
+	if video.ID == uuid.Nil || !ok {
+		respondWithError(w, http.StatusNotFound, "Stream not found", nil)
+		return
+	}
+	key := path.Join(baseKey, file)
+
+	// Segments are fetched straight from the blob store
+	if !isPlaylist(file) {
+		url, err := cfg.store.Presign(r.Context(), key, segmentURLExpiry)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign segment", err)
+			return
+		}
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+
+	body, info, err := cfg.store.Get(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "File not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get playlist", err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, body)
+}
+
+func isPlaylist(file string) bool {
+	ext := path.Ext(file)
+	return ext == ".m3u8" || ext == ".mpd"
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const thumbnailCandidateURLExpiry = 15 * time.Minute
+
+func (cfg *apiConfig) handlerThumbnailCandidatesList(w http.ResponseWriter, r *http.Request) {
+	type candidate struct {
+		Index    int    `json:"index"`
+		URL      string `json:"url"`
+		Selected bool   `json:"selected"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := cfg.listThumbnailCandidates(r.Context(), video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list thumbnail candidates", err)
+		return
+	}
+
+	prefix := thumbnailCandidatesPrefix(video.ID)
+	candidates := []candidate{}
+	for _, key := range keys {
+		url, err := cfg.store.Presign(r.Context(), key, thumbnailCandidateURLExpiry)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign thumbnail candidate", err)
+			return
+		}
+		candidates = append(candidates, candidate{
+			Index:    candidateIndex(prefix, key),
+			URL:      url,
+			Selected: video.ThumbnailSource != nil && *video.ThumbnailSource == key,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, candidates)
+}
+
+func (cfg *apiConfig) handlerThumbnailCandidateSelect(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	index, err := strconv.Atoi(r.PathValue("candidate"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid candidate", err)
+		return
+	}
+
+	keys, err := cfg.listThumbnailCandidates(r.Context(), video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list thumbnail candidates", err)
+		return
+	}
+	prefix := thumbnailCandidatesPrefix(video.ID)
+	i := slices.IndexFunc(keys, func(key string) bool { return candidateIndex(prefix, key) == index })
+	if i < 0 {
+		respondWithError(w, http.StatusNotFound, "Thumbnail candidate not found", nil)
+		return
+	}
+	key := keys[i]
+
+	img, err := cfg.loadBlobImage(r.Context(), key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't load thumbnail candidate", err)
+		return
+	}
+
+	video, err = cfg.replaceThumbnail(r.Context(), video, img, &key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error storing thumbnail", err)
+		return
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error generating signed video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
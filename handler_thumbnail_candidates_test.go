@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+func TestThumbnailCandidatesSelectedAfterReupload(t *testing.T) {
+	cfg := newTestConfig(t)
+	store, err := storage.NewLocalStore(t.TempDir(), "http://localhost:8091/blobs", []byte("test-secret"), maxVideoUploadSize)
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	cfg.store = store
+	ctx := context.Background()
+
+	user, jwt := createTestUser(t, cfg)
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+
+	// storeCandidates stands in for generating the candidates of an upload
+	storeCandidates := func(uploadSeq int64) {
+		t.Helper()
+		if err := cfg.deleteThumbnailCandidates(ctx, video.ID); err != nil {
+			t.Fatalf("deleteThumbnailCandidates: %v", err)
+		}
+		for i := range 3 {
+			key := thumbnailCandidateKey(video.ID, uploadSeq, i)
+			if err := store.Put(ctx, key, strings.NewReader("jpeg"), "image/jpeg"); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+	}
+	selected := func() []int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"/thumbnail_candidates", nil)
+		req.SetPathValue("videoID", video.ID.String())
+		req.Header.Set("Authorization", "Bearer "+jwt)
+		rec := httptest.NewRecorder()
+		cfg.authMiddleware(auth.ScopeVideosRead, cfg.handlerThumbnailCandidatesList).ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("listing candidates: %d %s", rec.Code, rec.Body)
+		}
+
+		var candidates []struct {
+			Index    int  `json:"index"`
+			Selected bool `json:"selected"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &candidates); err != nil {
+			t.Fatalf("decoding candidates: %v", err)
+		}
+		if len(candidates) != 3 {
+			t.Fatalf("listed %d candidates, want 3", len(candidates))
+		}
+		indexes := []int{}
+		for i, candidate := range candidates {
+			if candidate.Index != i {
+				t.Errorf("candidate %d has index %d", i, candidate.Index)
+			}
+			if candidate.Selected {
+				indexes = append(indexes, candidate.Index)
+			}
+		}
+		return indexes
+	}
+
+	storeCandidates(1)
+	source := thumbnailCandidateKey(video.ID, 1, 1)
+	if _, err := cfg.db.UpdateVideoThumbnails(video.ID, "thumbnails/picked.jpg", database.Thumbnails{}, &source); err != nil {
+		t.Fatalf("UpdateVideoThumbnails: %v", err)
+	}
+	if got := selected(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("selected %v, want [1]", got)
+	}
+
+	// The thumbnail is a frame of the previous upload
+	storeCandidates(2)
+	if got := selected(); len(got) != 0 {
+		t.Errorf("selected %v after a new upload, want none", got)
+	}
+}
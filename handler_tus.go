@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Resumable video uploads following the tus 1.0 protocol (https://tus.io)
+// with the creation, termination and expiration extensions. Every PATCH is
+// stored as its own chunk in the blob store so any replica can continue an
+// upload, and the chunks are assembled once the last byte arrives.
+
+const (
+	tusVersion      = "1.0.0"
+	tusExtensions   = "creation,termination,expiration"
+	tusUploadExpiry = 24 * time.Hour
+)
+
+func tusChunkPrefix(uploadID uuid.UUID) string {
+	return fmt.Sprintf("uploads/%s/", uploadID)
+}
+
+// tusChunkKey names the chunk at offset. The random suffix keeps two racing
+// PATCH requests for the same offset from overwriting each other's data,
+// only the one that advanced the offset has its key recorded.
+func tusChunkKey(uploadID uuid.UUID, offset int64) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%020d-%s", tusChunkPrefix(uploadID), offset, hex.EncodeToString(suffix)), nil
+}
+
+// tusSourceKey is where the assembled upload is staged for processing. It's
+// fixed per upload, and doubles as the job's dedupe key, so finishing the
+// same upload twice queues one job.
+func tusSourceKey(upload database.VideoUpload, extension string) string {
+	return fmt.Sprintf("uploads/staged/%s/%s.%s", upload.VideoID, upload.ID, extension)
+}
+
+// parseTusMetadata decodes an Upload-Metadata header, a comma separated list
+// of keys each followed by an optional base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %q is not base64 encoded: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithError(w, http.StatusPreconditionFailed, "Unsupported tus version", nil)
+		return false
+	}
+	return true
+}
+
+func setTusExpires(w http.ResponseWriter, upload database.VideoUpload) {
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+func (cfg *apiConfig) handlerTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxVideoUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerTusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	uploadLength, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || uploadLength <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Upload-Length must be a positive integer", err)
+		return
+	}
+	if uploadLength > maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Upload is too large", nil)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Metadata", err)
+		return
+	}
+
+	contentType := metadata["filetype"]
+	if contentType == "" {
+		contentType = "video/mp4"
+	}
+	if _, err := getVideoExtension(contentType); err != nil {
+		respondWithError(w, http.StatusNotAcceptable, "Not acceptable", err)
+		return
+	}
+
+	upload, err := cfg.db.CreateVideoUpload(database.CreateVideoUploadParams{
+		VideoID:      video.ID,
+		UserID:       video.UserID,
+		UploadLength: uploadLength,
+		ContentType:  contentType,
+		ExpiresAt:    time.Now().Add(tusUploadExpiry),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/tus/uploads/%s", upload.ID))
+	setTusExpires(w, upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// getTusUpload loads the upload in the request path and checks that it
+// belongs to the caller and hasn't expired. It writes the error response
+// itself and reports whether the request may continue.
+func (cfg *apiConfig) getTusUpload(w http.ResponseWriter, r *http.Request) (database.VideoUpload, bool) {
+	if !checkTusResumable(w, r) {
+		return database.VideoUpload{}, false
+	}
+
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload ID", err)
+		return database.VideoUpload{}, false
+	}
+
+	upload, err := cfg.db.GetVideoUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return database.VideoUpload{}, false
+	}
+	if upload.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return database.VideoUpload{}, false
+	}
+	if upload.UserID != requestUser(r).ID {
+		respondWithError(w, http.StatusForbidden, "You can't access this upload", nil)
+		return database.VideoUpload{}, false
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		respondWithError(w, http.StatusGone, "Upload expired", nil)
+		return database.VideoUpload{}, false
+	}
+	return upload, true
+}
+
+func (cfg *apiConfig) handlerTusHead(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.UploadLength, 10))
+	setTusExpires(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerTusPatch(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Offset", err)
+		return
+	}
+	if offset != upload.UploadOffset {
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match the current offset", nil)
+		return
+	}
+
+	// Spool the chunk to disk first, if the connection drops we still keep
+	// whatever arrived so the client can resume from there.
+	chunkFile, err := os.CreateTemp("", "tubely-chunk-*")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error", err)
+		return
+	}
+	defer os.Remove(chunkFile.Name())
+	defer chunkFile.Close()
+
+	remaining := upload.UploadLength - upload.UploadOffset
+	n, copyErr := io.Copy(chunkFile, io.LimitReader(r.Body, remaining))
+	if n > 0 {
+		if !cfg.storeTusChunk(w, r, &upload, chunkFile, n) {
+			return
+		}
+	}
+
+	if copyErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error reading chunk", copyErr)
+		return
+	}
+
+	// An empty PATCH on a complete upload retries processing that failed
+	if upload.UploadOffset == upload.UploadLength {
+		if err := cfg.finishTusUpload(r.Context(), upload); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error processing video", err)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+	setTusExpires(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// storeTusChunk saves n spooled bytes as the chunk at the upload's current
+// offset and advances the offset. It writes the error response itself.
+func (cfg *apiConfig) storeTusChunk(w http.ResponseWriter, r *http.Request, upload *database.VideoUpload, chunkFile *os.File, n int64) bool {
+	offset := upload.UploadOffset
+	if _, err := chunkFile.Seek(0, io.SeekStart); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error", err)
+		return false
+	}
+
+	chunkKey, err := tusChunkKey(upload.ID, offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Server error", err)
+		return false
+	}
+	err = cfg.store.Put(r.Context(), chunkKey, chunkFile, "application/octet-stream")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error storing chunk", err)
+		return false
+	}
+
+	upload.UploadOffset = offset + n
+	upload.ChunkKeys = append(upload.ChunkKeys, chunkKey)
+	upload.ExpiresAt = time.Now().Add(tusUploadExpiry)
+	advanced, err := cfg.db.AdvanceVideoUploadOffset(upload.ID, offset, upload.UploadOffset, chunkKey, upload.ExpiresAt)
+	if err != nil || !advanced {
+		cfg.store.Delete(context.Background(), chunkKey)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't update upload offset", err)
+			return false
+		}
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match the current offset", nil)
+		return false
+	}
+	return true
+}
+
+func (cfg *apiConfig) handlerTusDelete(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if err := cfg.deleteTusUpload(r.Context(), upload); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload stitches the stored chunks back together and queues the
+// file for the regular video processing pipeline.
+func (cfg *apiConfig) finishTusUpload(ctx context.Context, upload database.VideoUpload) error {
+	video, err := cfg.db.GetVideo(upload.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return fmt.Errorf("video %s no longer exists", upload.VideoID)
+	}
+
+	extension, err := getVideoExtension(upload.ContentType)
+	if err != nil {
+		return err
+	}
+
+	// Queued already by a request that then failed to clean up
+	sourceKey := tusSourceKey(upload, extension)
+	job, err := cfg.db.GetJobByDedupeKey(sourceKey)
+	if err != nil {
+		return err
+	}
+	if job.ID != uuid.Nil {
+		return cfg.deleteTusUpload(ctx, upload)
+	}
+
+	videoFile, err := os.CreateTemp("", fmt.Sprintf("%s.%s", upload.VideoID, extension))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(videoFile.Name())
+	defer videoFile.Close()
+
+	if err := cfg.assembleTusChunks(ctx, upload, videoFile); err != nil {
+		return err
+	}
+
+	if _, err := videoFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := cfg.store.Put(ctx, sourceKey, videoFile, upload.ContentType); err != nil {
+		return err
+	}
+
+	if _, err := cfg.queueVideoProcessing(video.ID, sourceKey, upload.ContentType); err != nil {
+		cfg.store.Delete(ctx, sourceKey)
+		return err
+	}
+
+	return cfg.deleteTusUpload(ctx, upload)
+}
+
+// assembleTusChunks writes the chunks recorded for the upload to dst. Chunks
+// left behind by PATCH requests that lost the race for an offset aren't
+// recorded, and are skipped.
+func (cfg *apiConfig) assembleTusChunks(ctx context.Context, upload database.VideoUpload, dst io.Writer) error {
+	var written int64
+	for _, chunkKey := range upload.ChunkKeys {
+		body, _, err := cfg.store.Get(ctx, chunkKey)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(dst, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+		written += n
+	}
+
+	if written != upload.UploadLength {
+		return fmt.Errorf("assembled %d bytes, expected %d", written, upload.UploadLength)
+	}
+	return nil
+}
+
+func (cfg *apiConfig) deleteTusUpload(ctx context.Context, upload database.VideoUpload) error {
+	chunks, err := cfg.store.List(ctx, tusChunkPrefix(upload.ID))
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if err := cfg.store.Delete(ctx, chunk.Key); err != nil {
+			return err
+		}
+	}
+	return cfg.db.DeleteVideoUpload(upload.ID)
+}
+
+// expireTusUploads periodically removes uploads that clients abandoned.
+func (cfg *apiConfig) expireTusUploads(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		uploads, err := cfg.db.GetExpiredVideoUploads(time.Now())
+		if err != nil {
+			log.Printf("Couldn't list expired uploads: %v", err)
+		}
+		for _, upload := range uploads {
+			if err := cfg.deleteTusUpload(ctx, upload); err != nil {
+				log.Printf("Couldn't delete expired upload %s: %v", upload.ID, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
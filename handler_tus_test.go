@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+func TestTusUploadAssemblesRecordedChunks(t *testing.T) {
+	cfg := newTestConfig(t)
+	store, err := storage.NewLocalStore(t.TempDir(), "http://localhost:8091/blobs", []byte("test-secret"), maxVideoUploadSize)
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	cfg.store = store
+	ctx := context.Background()
+
+	user, jwt := createTestUser(t, cfg)
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	upload, err := cfg.db.CreateVideoUpload(database.CreateVideoUploadParams{
+		VideoID:      video.ID,
+		UserID:       user.ID,
+		UploadLength: int64(len("helloworld")),
+		ContentType:  "video/mp4",
+		ExpiresAt:    time.Now().Add(tusUploadExpiry),
+	})
+	if err != nil {
+		t.Fatalf("CreateVideoUpload: %v", err)
+	}
+
+	// A PATCH that lost the race for offset 0 left its chunk behind, under a
+	// key sorting before any other
+	leftover := tusChunkPrefix(upload.ID) + "00000000000000000000-0000000000000000"
+	if err := store.Put(ctx, leftover, strings.NewReader("HELLO"), "application/octet-stream"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	patch := func(offset int64, chunk string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPatch, "/api/tus/uploads/"+upload.ID.String(), strings.NewReader(chunk))
+		req.SetPathValue("uploadID", upload.ID.String())
+		req.Header.Set("Authorization", "Bearer "+jwt)
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		rec := httptest.NewRecorder()
+		cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerTusPatch).ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("PATCH at %d: %d %s", offset, rec.Code, rec.Body)
+		}
+	}
+	patch(0, "hello")
+	complete, err := cfg.db.GetVideoUpload(upload.ID)
+	if err != nil {
+		t.Fatalf("GetVideoUpload: %v", err)
+	}
+	patch(5, "world")
+
+	sourceKey := tusSourceKey(upload, "mp4")
+	body, _, err := store.Get(ctx, sourceKey)
+	if err != nil {
+		t.Fatalf("getting the assembled upload: %v", err)
+	}
+	assembled, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(assembled) != "helloworld" {
+		t.Errorf("assembled %q, want %q", assembled, "helloworld")
+	}
+
+	// A concurrent request finishing the same upload queues nothing more
+	complete.UploadOffset = complete.UploadLength
+	if err := cfg.finishTusUpload(ctx, complete); err != nil {
+		t.Fatalf("finishing again: %v", err)
+	}
+	jobs, err := cfg.db.GetUnfinishedJobs(jobTypeProcessVideo)
+	if err != nil {
+		t.Fatalf("GetUnfinishedJobs: %v", err)
+	}
+	if len(jobs) != 1 {
+		t.Errorf("queued %d jobs, want 1", len(jobs))
+	}
+
+	chunks, err := store.List(ctx, tusChunkPrefix(upload.ID))
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(chunks) != 0 {
+		t.Errorf("%d chunks left after finishing", len(chunks))
+	}
+}
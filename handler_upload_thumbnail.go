@@ -5,13 +5,7 @@ import (
 	"io"
 	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
-	"time"
-
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
-	"github.com/google/uuid"
 )
 
 func getImageExtension(s string) (string, error) {
@@ -31,46 +25,13 @@ func getImageExtension(s string) (string, error) {
 }
 
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
-	videoIDString := r.PathValue("videoID")
-	videoID, err := uuid.Parse(videoIDString)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
-		return
-	}
-
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
-	}
-
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
-		return
-	}
-
-	video, err := cfg.db.GetVideo(videoID)
-	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Video not found", err)
-		return
-	}
-
-	user, err := cfg.db.GetUser(userID)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "User not found", err)
-		return
-	}
-
-	if video.UserID != user.ID {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized", err)
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
 		return
 	}
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
-
-	// TODO: implement the upload here
 	const maxMemory = 10 << 20
+	r.Body = http.MaxBytesReader(w, r.Body, maxMemory)
 	r.ParseMultipartForm(maxMemory)
 
 	file, header, err := r.FormFile("thumbnail")
@@ -80,8 +41,10 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 
 	}
 	defer file.Close()
-	contentType := header.Header.Get("Content-Type") // just assume that even an empty mime-type is valid
-	extension, err := getImageExtension(contentType)
+	// The real format is checked when decoding, this only rejects obvious
+	// mistakes early
+	contentType := header.Header.Get("Content-Type")
+	_, err = getImageExtension(contentType)
 
 	if err != nil {
 		respondWithError(w, http.StatusNotAcceptable, "Not acceptable", err)
@@ -96,38 +59,23 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	thumbnailFilename := fmt.Sprintf("%s.%s", video.ID.String(), extension)
-	savePath := filepath.Join(cfg.assetsRoot, thumbnailFilename)
-	thumbnailFile, err := os.Create(savePath)
-
+	img, err := decodeThumbnail(data)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Server error", err)
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode image", err)
 		return
 	}
-	defer thumbnailFile.Close()
 
-	if _, err = thumbnailFile.Write(data); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Server error", err)
+	video, err = cfg.replaceThumbnail(r.Context(), video, img, nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error storing thumbnail", err)
 		return
 	}
 
-	scheme := "http"
-
-	if r.TLS != nil {
-		scheme = "https"
-	}
-
-	thumbnailUrl := fmt.Sprintf("%s://%s/assets/%s.%s", scheme, r.Host, video.ID.String(), extension)
-	video.UpdatedAt = time.Now()
-	video.ThumbnailURL = &thumbnailUrl
-
-	err = cfg.db.UpdateVideo(video)
-
+	signedVideo, err := cfg.dbVideoToSignedVideo(video)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error updating data", err)
+		respondWithError(w, http.StatusInternalServerError, "Error generating signed video", err)
 		return
-
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	respondWithJSON(w, http.StatusOK, signedVideo)
 }
@@ -6,7 +6,6 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"mime"
 	"net/http"
@@ -15,19 +14,24 @@ import (
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
-	"github.com/google/uuid"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 )
 
 type FFProbeVideoInfo struct {
 	Programs     []interface{} `json:"programs"`
 	StreamGroups []interface{} `json:"stream_groups"`
 	Streams      []struct {
-		Width              int    `json:"width,omitempty"`
-		Height             int    `json:"height,omitempty"`
-		DisplayAspectRatio string `json:"display_aspect_ratio,omitempty"`
+		CodecName          string            `json:"codec_name,omitempty"`
+		CodecType          string            `json:"codec_type,omitempty"`
+		Width              int               `json:"width,omitempty"`
+		Height             int               `json:"height,omitempty"`
+		DisplayAspectRatio string            `json:"display_aspect_ratio,omitempty"`
+		RFrameRate         string            `json:"r_frame_rate,omitempty"`
+		AvgFrameRate       string            `json:"avg_frame_rate,omitempty"`
+		BitRate            string            `json:"bit_rate,omitempty"`
+		Channels           int               `json:"channels,omitempty"`
+		ChannelLayout      string            `json:"channel_layout,omitempty"`
+		SideDataList       []FFProbeSideData `json:"side_data_list,omitempty"`
 		Disposition        struct {
 			Default         int `json:"default"`
 			Dub             int `json:"dub"`
@@ -55,8 +59,29 @@ type FFProbeVideoInfo struct {
 			VendorID    string `json:"vendor_id"`
 			Encoder     string `json:"encoder"`
 			Timecode    string `json:"timecode"`
+			Rotate      string `json:"rotate"`
 		} `json:"tags"`
 	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+type FFProbeSideData struct {
+	SideDataType string  `json:"side_data_type"`
+	Rotation     float64 `json:"rotation"`
+}
+
+const maxVideoUploadSize = 10 << 30
+
+func randomHex(numBytes int) (string, error) {
+	randomBytes := make([]byte, numBytes)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
 }
 
 func processVideoForFastStart(filePath string) (string, error) {
@@ -71,41 +96,56 @@ func processVideoForFastStart(filePath string) (string, error) {
 	return outputFilePath, nil
 }
 
-func generatePresignedURL(s3Client *s3.Client, bucket, key string, expireTime time.Duration) (string, error) {
-	presignClient := s3.NewPresignClient(s3Client)
-	params := &s3.GetObjectInput{
-		Bucket: &bucket,
-		Key:    &key,
-	}
-	presignedReq, err := presignClient.PresignGetObject(context.Background(), params, s3.WithPresignExpires(expireTime))
-	if err != nil {
-		return "", err
-	}
-	return presignedReq.URL, nil
-}
-
-func getVideoAspectRatio(filePath string) (string, error) {
-	// use ffprobe to get the video aspect ratio
+func probeVideo(filePath string) (FFProbeVideoInfo, error) {
 	exec.Command("ffprobe").Run() // ensure ffprobe is installed
-	// ffprobe -v error -show_streams samples/boots-video-horizontal.mp4 -show_entries stream=display_aspect_ratio,width,height -print_format json
-	cmd := exec.Command("ffprobe", "-v", "error", "-show_streams", filePath, "-show_entries", "stream=display_aspect_ratio", "-print_format", "json")
+	// ffprobe -v error -show_streams -show_format samples/boots-video-horizontal.mp4 -print_format json
+	cmd := exec.Command("ffprobe", "-v", "error", "-show_streams", "-show_format", filePath, "-print_format", "json")
 	output, err := cmd.Output()
 
 	if err != nil {
-		return "", err
+		return FFProbeVideoInfo{}, err
 	}
 
 	var info FFProbeVideoInfo
 	err = json.Unmarshal(output, &info)
 	if err != nil {
-		return "", err
+		return FFProbeVideoInfo{}, err
 	}
 
 	if len(info.Streams) == 0 {
-		return "", fmt.Errorf("no streams found")
+		return FFProbeVideoInfo{}, fmt.Errorf("no streams found")
+	}
+	return info, nil
+}
+
+// videoStreamIndex returns the index of the first video stream, falling back
+// to the first stream for probes that don't report codec types.
+func (info FFProbeVideoInfo) videoStreamIndex() int {
+	for i, stream := range info.Streams {
+		if stream.CodecType == "video" {
+			return i
+		}
+	}
+	return 0
+}
+
+// hasAudio reports whether the probe found an audio stream.
+func (info FFProbeVideoInfo) hasAudio() bool {
+	for _, stream := range info.Streams {
+		if stream.CodecType == "audio" {
+			return true
+		}
 	}
+	return false
+}
 
-	return info.Streams[0].DisplayAspectRatio, nil
+func getVideoAspectRatio(filePath string) (string, error) {
+	// use ffprobe to get the video aspect ratio
+	info, err := probeVideo(filePath)
+	if err != nil {
+		return "", err
+	}
+	return info.Streams[info.videoStreamIndex()].DisplayAspectRatio, nil
 }
 
 func getVideoExtension(s string) (string, error) {
@@ -124,165 +164,210 @@ func getVideoExtension(s string) (string, error) {
 	return "", fmt.Errorf("not an video")
 }
 
-func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
-	videoIDString := r.PathValue("videoID")
-	videoID, err := uuid.Parse(videoIDString)
+// processVideo turns the upload at filePath into the video's file and
+// renditions. Uploads are numbered by uploadSeq, a file is only replaced by
+// a later upload and the file it replaces is kept as a version.
+func (cfg *apiConfig) processVideo(ctx context.Context, video database.Video, uploadSeq int64, filePath, extension, contentType string) (database.Video, error) {
+	// process the video for fast start
+	fastStartVideoFilePath, err := processVideoForFastStart(filePath)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
-		return
+		return database.Video{}, fmt.Errorf("error processing video for fast start: %w", err)
 	}
+	defer os.Remove(fastStartVideoFilePath)
 
-	token, err := auth.GetBearerToken(r.Header)
+	fastStartedVideoFile, err := os.Open(fastStartVideoFilePath)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
+		return database.Video{}, fmt.Errorf("error opening video file with fast start version: %w", err)
 	}
+	defer fastStartedVideoFile.Close()
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	// determine the aspect ratio of the video
+	info, err := probeVideo(fastStartedVideoFile.Name())
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
-		return
+		return database.Video{}, fmt.Errorf("error determining aspect ratio: %w", err)
 	}
+	videoStream := info.Streams[info.videoStreamIndex()]
+	aspectRatio := videoStream.DisplayAspectRatio
+	metadata := videoMetadata(info)
+	// ffmpeg applies the rotation when transcoding, size renditions to match
+	width, height := displaySize(videoStream.Width, videoStream.Height, *metadata.Rotation)
 
-	video, err := cfg.db.GetVideo(videoID)
-	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Video not found", err)
-		return
+	mappingOfAspectRatios := map[string]string{
+		"16:9":  "landscape",
+		"9:16":  "portrait",
+		"other": "other",
 	}
 
-	user, err := cfg.db.GetUser(userID)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "User not found", err)
-		return
+	namedAspectRatio, ok := mappingOfAspectRatios[aspectRatio]
+
+	if !ok {
+		namedAspectRatio = "other"
 	}
 
-	if video.UserID != user.ID {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized", err)
-		return
+	hexString, err := randomHex(32)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("error generating random bytes: %w", err)
 	}
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
+	keyFilename := fmt.Sprintf("%s/%s.%s", namedAspectRatio, hexString, extension)
 
-	const maxMemory = 10 << 30
-	http.MaxBytesReader(w, r.Body, maxMemory)
+	// Renditions live next to the MP4, e.g. landscape/<hex>/hls/720p/index.m3u8
+	renditionPrefix := strings.TrimSuffix(keyFilename, "."+extension)
+	// Nothing points at the new blobs until the row is updated, remove them
+	// if we don't get that far. The garbage collector catches the rest.
+	newFile := deleteVideoBlobsPayload{
+		VideoID:  video.ID,
+		Keys:     []string{keyFilename},
+		Prefixes: []string{renditionPrefix + "/"},
+	}
+	discard := func() {
+		if err := cfg.deleteBlobs(context.WithoutCancel(ctx), newFile); err != nil {
+			log.Printf("Couldn't delete unused file %s of video %s: %v", keyFilename, video.ID, err)
+		}
+	}
 
-	file, header, err := r.FormFile("video")
+	err = cfg.store.Put(ctx, keyFilename, fastStartedVideoFile, contentType)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error processing request", err)
-		return
-
+		discard()
+		return database.Video{}, fmt.Errorf("error uploading video: %w", err)
 	}
-	defer file.Close()
-	contentType := header.Header.Get("Content-Type") // just assume that even an empty mime-type is valid
-	extension, err := getVideoExtension(contentType)
 
+	frameRate := 0.0
+	if metadata.FrameRate != nil {
+		frameRate = *metadata.FrameRate
+	}
+	hlsMasterKey, err := cfg.transcodeHLS(ctx, fastStartVideoFilePath, width, height, frameRate, info.hasAudio(), renditionPrefix+"/hls")
 	if err != nil {
-		respondWithError(w, http.StatusNotAcceptable, "Not acceptable", err)
-		return
-
+		discard()
+		return database.Video{}, fmt.Errorf("error transcoding HLS: %w", err)
 	}
 
-	videoFilename := fmt.Sprintf("%s.%s", video.ID.String(), extension)
-	videoFile, err := os.CreateTemp("", videoFilename)
+	var dashManifestKey *string
+	if cfg.dashEnabled {
+		key, err := cfg.transcodeDASH(ctx, fastStartVideoFilePath, width, height, info.hasAudio(), renditionPrefix+"/dash")
+		if err != nil {
+			discard()
+			return database.Video{}, fmt.Errorf("error transcoding DASH: %w", err)
+		}
+		dashManifestKey = &key
+	}
 
+	video.UpdatedAt = time.Now()
+	video.VideoURL = &keyFilename
+	video.HLSURL = &hlsMasterKey
+	video.DASHURL = dashManifestKey
+	video.VideoMetadata = metadata
+	video.Status = database.VideoStatusReady
+
+	replaced, err := cfg.db.ReplaceVideoFile(video, uploadSeq, cfg.videoVersionRetention, func(pruned []database.VideoVersion) database.CreateJobParams {
+		return database.CreateJobParams{
+			Type:        jobTypeDeleteVideoBlobs,
+			Payload:     videoVersionBlobs(video.ID, pruned),
+			MaxAttempts: deleteVideoBlobsMaxAttempts,
+		}
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Server error", err)
-		return
+		// The commit may have gone through, leave the blobs to the garbage
+		// collector
+		return database.Video{}, fmt.Errorf("error updating video: %w", err)
+	}
+	if !replaced {
+		// A later upload finished first, or the video is gone
+		log.Printf("Upload %d of video %s was superseded, discarding it", uploadSeq, video.ID)
+		discard()
+		return video, nil
 	}
-	defer videoFile.Close()
-	defer os.Remove(videoFile.Name())
-
-	_, err = io.Copy(videoFile, file)
 
+	// A missing thumbnail shouldn't fail an otherwise playable video
+	duration := 0.0
+	if metadata.DurationSeconds != nil {
+		duration = *metadata.DurationSeconds
+	}
+	candidateKey, err := cfg.generateThumbnailCandidates(ctx, video.ID, uploadSeq, fastStartVideoFilePath, duration)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Server error", err)
-		return
+		log.Printf("Couldn't generate thumbnails for video %s: %v", video.ID, err)
+		return video, nil
 	}
+	if video.ThumbnailURL == nil {
+		video = cfg.setDefaultThumbnail(ctx, video, candidateKey)
+	}
+	return video, nil
+}
 
-	// process the video for fast start
-	fastStartVideoFilePath, err := processVideoForFastStart(videoFile.Name())
+// setDefaultThumbnail makes the candidate at candidateKey the thumbnail of a
+// video that has none yet.
+func (cfg *apiConfig) setDefaultThumbnail(ctx context.Context, video database.Video, candidateKey string) database.Video {
+	img, err := cfg.loadBlobImage(ctx, candidateKey)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error processing video for fast start", err)
-		return
+		log.Printf("Couldn't load thumbnail candidate %s: %v", candidateKey, err)
+		return video
 	}
-
-	fastStartedVideoFile, err := os.Open(fastStartVideoFilePath)
-
+	thumbnails, err := cfg.storeThumbnailVariants(ctx, video.ID, img)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error opening video file with fast start version", err)
-		return
+		log.Printf("Couldn't store thumbnail for video %s: %v", video.ID, err)
+		return video
 	}
 
-	defer fastStartedVideoFile.Close()
-	defer os.Remove(fastStartVideoFilePath)
-
-	// determine the aspect ratio of the video
-	aspectRatio, err := getVideoAspectRatio(fastStartedVideoFile.Name())
-
+	thumbnailKey := defaultThumbnailKey(thumbnails)
+	set, err := cfg.db.SetDefaultThumbnail(video.ID, thumbnailKey, thumbnails, candidateKey)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error determining aspect ratio", err)
-		return
+		log.Printf("Couldn't set default thumbnail for video %s: %v", video.ID, err)
 	}
-
-	mappingOfAspectRatios := map[string]string{
-		"16:9":  "landscape",
-		"9:16":  "portrait",
-		"other": "other",
+	if !set {
+		// The owner uploaded a thumbnail while we were busy
+		cfg.deleteThumbnailVariants(ctx, thumbnails)
+		return video
 	}
+	video.ThumbnailURL = &thumbnailKey
+	video.Thumbnails = thumbnails
+	video.ThumbnailSource = &candidateKey
+	return video
+}
 
-	namedAspectRatio, ok := mappingOfAspectRatios[aspectRatio]
-
+func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
 	if !ok {
-		namedAspectRatio = "other"
-	}
-	_, err = videoFile.Seek(0, 0)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Server error", err)
 		return
 	}
 
-	numBytes := 32
-	randomBytes := make([]byte, numBytes)
+	r.Body = http.MaxBytesReader(w, r.Body, maxVideoUploadSize)
 
-	// Read random bytes into the slice
-	_, err = rand.Read(randomBytes)
+	file, header, err := r.FormFile("video")
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error generating random bytes", err)
+		respondWithError(w, http.StatusInternalServerError, "Error processing request", err)
 		return
-	}
 
-	// Encode the random bytes into a hexadecimal string
-	hexString := hex.EncodeToString(randomBytes)
+	}
+	defer file.Close()
+	contentType := header.Header.Get("Content-Type") // just assume that even an empty mime-type is valid
+	extension, err := getVideoExtension(contentType)
 
-	keyFilename := fmt.Sprintf("%s/%s.%s", namedAspectRatio, hexString, extension)
+	if err != nil {
+		respondWithError(w, http.StatusNotAcceptable, "Not acceptable", err)
+		return
 
-	// upload to S3
-	_, err = cfg.s3Client.PutObject(r.Context(), &s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
-		Key:         aws.String(fmt.Sprintf("%s,%s", cfg.s3Bucket, keyFilename)),
-		Body:        fastStartedVideoFile,
-		ContentType: &contentType,
-	})
+	}
 
+	// Stage the raw upload in the blob store, a worker picks it up from there
+	sourceKey, err := stagedUploadKey(video.ID, extension)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error uploading to S3", err)
+		respondWithError(w, http.StatusInternalServerError, "Server error", err)
 		return
 	}
 
-	scheme := "https"
-
-	videoUrl := fmt.Sprintf("%s://%s.s3.%s.amazonaws.com/%s,%s", scheme, cfg.s3Bucket, cfg.s3Region, cfg.s3Bucket, keyFilename)
-	video.UpdatedAt = time.Now()
-	video.VideoURL = &videoUrl
-
-	err = cfg.db.UpdateVideo(video)
+	err = cfg.store.Put(r.Context(), sourceKey, file, contentType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error storing upload", err)
+		return
+	}
 
+	video, err = cfg.queueVideoProcessing(video.ID, sourceKey, contentType)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error updating video", err)
+		cfg.store.Delete(r.Context(), sourceKey)
+		respondWithError(w, http.StatusInternalServerError, "Error queueing video for processing", err)
 		return
 	}
 
-	// generate a signed URL for the video
 	signedVideo, err := cfg.dbVideoToSignedVideo(video)
 
 	if err != nil {
@@ -290,8 +375,5 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	log.Printf("Video URl: %s\n", *video.VideoURL)
-	log.Printf("Signed Video URl: %s\n", *signedVideo.VideoURL)
-
-	respondWithJSON(w, http.StatusOK, signedVideo)
+	respondWithJSON(w, http.StatusAccepted, signedVideo)
 }
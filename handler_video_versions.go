@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type videoVersionResponse struct {
+	database.VideoVersion
+	Current bool `json:"current"`
+}
+
+func (cfg *apiConfig) handlerVideoVersionsList(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve versions", err)
+		return
+	}
+
+	resp := []videoVersionResponse{}
+	for _, version := range versions {
+		current := video.VideoURL != nil && *video.VideoURL == version.VideoURL
+		// Stored as the blob store key like the video's own URL, see
+		// dbVideoToSignedVideo
+		signedURL, err := cfg.store.Presign(context.Background(), videoStorageKey(version.VideoURL), 15*60*time.Second)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error generating signed URL", err)
+			return
+		}
+		version.VideoURL = signedURL
+		// Streams are only served for the current file
+		version.HLSURL = nil
+		version.DASHURL = nil
+		resp = append(resp, videoVersionResponse{
+			VideoVersion: version,
+			Current:      current,
+		})
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerVideoVersionRestore makes an earlier version the video's current
+// file. The thumbnail and the video's other fields are left alone.
+func (cfg *apiConfig) handlerVideoVersionRestore(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil || version < 1 {
+		respondWithError(w, http.StatusBadRequest, "Invalid version", err)
+		return
+	}
+
+	video, err = cfg.db.RestoreVideoVersion(video.ID, version)
+	if errors.Is(err, database.ErrVideoProcessing) {
+		respondWithError(w, http.StatusConflict, "Video is being processed, try again once it's done", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't restore version", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Version not found", nil)
+		return
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error generating signed video", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
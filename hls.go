@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// HLS renditions are transcoded with one ffmpeg run each and tied together by
+// a master playlist we write ourselves.
+
+const hlsMasterPlaylist = "master.m3u8"
+
+// transcodeHLS builds the HLS ladder for the video at filePath and uploads it
+// under prefix. It returns the key of the master playlist.
+func (cfg *apiConfig) transcodeHLS(ctx context.Context, filePath string, width, height int, frameRate float64, hasAudio bool, prefix string) (string, error) {
+	if width <= 0 || height <= 0 {
+		return "", fmt.Errorf("invalid video dimensions %dx%d", width, height)
+	}
+
+	outputDir, err := os.MkdirTemp("", "tubely-hls-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(outputDir)
+
+	var master strings.Builder
+	master.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+
+	for _, rendition := range videoRenditions(width, height) {
+		renditionWidth, renditionHeight := renditionSize(width, height, rendition.height)
+		renditionDir := filepath.Join(outputDir, rendition.name)
+		if err := os.Mkdir(renditionDir, 0755); err != nil {
+			return "", err
+		}
+
+		// Pin the level so the CODECS we advertise match the stream
+		level := h264Level(renditionWidth, renditionHeight, frameRate)
+		codecs := fmt.Sprintf("avc1.4d40%02x", level)
+
+		args := []string{"-y", "-i", filePath, "-map", "0:v:0"}
+		if hasAudio {
+			args = append(args, "-map", "0:a:0")
+		}
+		args = append(args,
+			"-vf", fmt.Sprintf("scale=%d:%d", renditionWidth, renditionHeight),
+			"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main",
+			"-level:v", fmt.Sprintf("%d.%d", level/10, level%10),
+			"-b:v", fmt.Sprintf("%dk", rendition.videoBitrate),
+			"-maxrate", fmt.Sprintf("%dk", rendition.videoBitrate*107/100),
+			"-bufsize", fmt.Sprintf("%dk", rendition.videoBitrate*3/2),
+			// Keyframes on segment boundaries so every segment starts clean
+			"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentSeconds),
+			"-sc_threshold", "0",
+		)
+		bandwidth := rendition.videoBitrate
+		if hasAudio {
+			args = append(args, "-c:a", "aac", "-ac", "2", "-b:a", fmt.Sprintf("%dk", rendition.audioBitrate))
+			bandwidth += rendition.audioBitrate
+			codecs += ",mp4a.40.2"
+		}
+		args = append(args,
+			"-f", "hls",
+			"-hls_time", fmt.Sprint(segmentSeconds),
+			"-hls_playlist_type", "vod",
+			"-hls_segment_filename", filepath.Join(renditionDir, "segment_%04d.ts"),
+			filepath.Join(renditionDir, "index.m3u8"),
+		)
+		cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("ffmpeg %s rendition: %w: %s", rendition.name, err, lastLines(output, 5))
+		}
+
+		fmt.Fprintf(&master, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s\"\n%s/index.m3u8\n",
+			bandwidth*1000,
+			renditionWidth,
+			renditionHeight,
+			codecs,
+			rendition.name,
+		)
+	}
+
+	if err := os.WriteFile(filepath.Join(outputDir, hlsMasterPlaylist), []byte(master.String()), 0644); err != nil {
+		return "", err
+	}
+
+	if err := cfg.uploadDir(ctx, outputDir, prefix, streamContentTypes); err != nil {
+		return "", err
+	}
+	return path.Join(prefix, hlsMasterPlaylist), nil
+}
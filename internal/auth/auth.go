@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -20,6 +21,15 @@ const (
 	TokenTypeAccess TokenType = "tubely-access"
 )
 
+// Scopes an API key can be granted
+const (
+	ScopeVideosRead  = "videos:read"
+	ScopeVideosWrite = "videos:write"
+)
+
+// APIKeyPrefix starts every API key, so leaked keys are easy to spot
+const APIKeyPrefix = "tubely_"
+
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
 
 func HashPassword(password string) (string, error) {
@@ -34,32 +44,84 @@ func CheckPasswordHash(password, hash string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
 
+// AccessToken is what an access JWT says about its holder.
+type AccessToken struct {
+	UserID uuid.UUID
+	// Generation is the user's token generation when the token was issued;
+	// bumping it invalidates every token issued before
+	Generation int64
+	// SessionID is the login the token was issued to, if any. Tokens die
+	// with their session.
+	SessionID uuid.UUID
+}
+
+type accessTokenClaims struct {
+	jwt.RegisteredClaims
+	Generation int64  `json:"gen,omitempty"`
+	SessionID  string `json:"sid,omitempty"`
+}
+
+func newAccessTokenClaims(accessToken AccessToken, now time.Time, expiresIn time.Duration) accessTokenClaims {
+	claims := accessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    string(TokenTypeAccess),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+			Subject:   accessToken.UserID.String(),
+		},
+		Generation: accessToken.Generation,
+	}
+	if accessToken.SessionID != uuid.Nil {
+		claims.SessionID = accessToken.SessionID.String()
+	}
+	return claims
+}
+
+// accessToken checks that a verified token is an access token and returns
+// what it says.
+func (claims accessTokenClaims) accessToken(token *jwt.Token) (AccessToken, error) {
+	userID, err := accessTokenUserID(token)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	accessToken := AccessToken{UserID: userID, Generation: claims.Generation}
+	if claims.SessionID != "" {
+		accessToken.SessionID, err = uuid.Parse(claims.SessionID)
+		if err != nil {
+			return AccessToken{}, fmt.Errorf("invalid session ID: %w", err)
+		}
+	}
+	return accessToken, nil
+}
+
 func MakeJWT(
-	userID uuid.UUID,
+	accessToken AccessToken,
 	tokenSecret string,
 	expiresIn time.Duration,
 ) (string, error) {
 	signingKey := []byte(tokenSecret)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject:   userID.String(),
-	})
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, newAccessTokenClaims(accessToken, time.Now().UTC(), expiresIn))
 	return token.SignedString(signingKey)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claimsStruct := jwt.RegisteredClaims{}
+// ValidateJWT checks an HS256 access token.
+func ValidateJWT(tokenString, tokenSecret string) (AccessToken, error) {
+	claimsStruct := accessTokenClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
 		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
 	)
 	if err != nil {
-		return uuid.Nil, err
+		return AccessToken{}, err
 	}
+	return claimsStruct.accessToken(token)
+}
 
+// accessTokenUserID checks that a verified token is an access token and
+// returns its subject.
+func accessTokenUserID(token *jwt.Token) (uuid.UUID, error) {
 	userIDString, err := token.Claims.GetSubject()
 	if err != nil {
 		return uuid.Nil, err
@@ -94,6 +156,11 @@ func GetBearerToken(headers http.Header) (string, error) {
 }
 
 func MakeRefreshToken() (string, error) {
+	return MakeToken()
+}
+
+// MakeToken returns a random 256 bit token, hex encoded.
+func MakeToken() (string, error) {
 	token := make([]byte, 32)
 	_, err := rand.Read(token)
 	if err != nil {
@@ -102,6 +169,22 @@ func MakeRefreshToken() (string, error) {
 	return hex.EncodeToString(token), nil
 }
 
+// HashToken returns the hash a token is stored under. Tokens are random, so
+// a fast hash is enough to make a leaked table useless.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// MakeAPIKey returns a new random API key.
+func MakeAPIKey() (string, error) {
+	token, err := MakeToken()
+	if err != nil {
+		return "", err
+	}
+	return APIKeyPrefix + token, nil
+}
+
 func GetAPIKey(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTKeys signs and verifies access JWTs. With asymmetric keys, tokens are
+// signed with RS256 or EdDSA and carry the key ID in their kid header, so
+// services holding only the public keys can verify them but not mint them.
+// Without keys, tokens are signed with HS256 and a shared secret.
+type JWTKeys struct {
+	// keys is sorted by ActiveFrom
+	keys []JWTKey
+	// secret verifies, and without keys signs, HS256 tokens. It's empty
+	// when HS256 tokens aren't accepted.
+	secret string
+}
+
+// JWTKey is an asymmetric key. Keys without a private key only verify, for
+// keys being retired whose tokens haven't all expired yet.
+type JWTKey struct {
+	ID         string
+	Method     jwt.SigningMethod
+	Private    crypto.Signer
+	Public     crypto.PublicKey
+	ActiveFrom time.Time
+}
+
+// NewHMACKeys returns keys that sign and verify HS256 tokens with secret.
+func NewHMACKeys(secret string) *JWTKeys {
+	return &JWTKeys{secret: secret}
+}
+
+// jwtKeysFile is the format of the file LoadJWTKeys reads.
+type jwtKeysFile struct {
+	Keys []struct {
+		ID             string    `json:"kid"`
+		PrivateKeyFile string    `json:"private_key_file"`
+		PublicKeyFile  string    `json:"public_key_file"`
+		ActiveFrom     time.Time `json:"active_from"`
+	} `json:"keys"`
+}
+
+// LoadJWTKeys reads a JSON file listing asymmetric keys:
+//
+//	{"keys": [{"kid": "2026-10", "private_key_file": "2026-10.pem", "active_from": "2026-10-01T00:00:00Z"}]}
+//
+// Key files are PEM encoded RSA or Ed25519 keys, relative to the JSON file.
+// Tokens are signed with the private key that became active last, so a
+// key listed ahead of its active_from is published for verifiers before it
+// signs anything. hmacSecret, if set, keeps HS256 tokens valid while
+// switching over.
+func LoadJWTKeys(path string, hmacSecret string, now time.Time) (*JWTKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file jwtKeysFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %w", path, err)
+	}
+
+	keys := &JWTKeys{secret: hmacSecret}
+	seen := map[string]bool{}
+	dir := filepath.Dir(path)
+	for _, k := range file.Keys {
+		if k.ID == "" {
+			return nil, errors.New("every key needs a kid")
+		}
+		if seen[k.ID] {
+			return nil, fmt.Errorf("duplicate kid %q", k.ID)
+		}
+		seen[k.ID] = true
+
+		key := JWTKey{ID: k.ID, ActiveFrom: k.ActiveFrom}
+		switch {
+		case k.PrivateKeyFile != "":
+			key.Private, err = readPrivateKey(filepath.Join(dir, k.PrivateKeyFile))
+			if err == nil {
+				key.Public = key.Private.Public()
+			}
+		case k.PublicKeyFile != "":
+			key.Public, err = readPublicKey(filepath.Join(dir, k.PublicKeyFile))
+		default:
+			err = errors.New("private_key_file or public_key_file is required")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.ID, err)
+		}
+
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			if public.N.BitLen() < 2048 {
+				return nil, fmt.Errorf("key %q: RSA keys must be at least 2048 bits", k.ID)
+			}
+			key.Method = jwt.SigningMethodRS256
+		case ed25519.PublicKey:
+			key.Method = jwt.SigningMethodEdDSA
+		default:
+			return nil, fmt.Errorf("key %q: keys must be RSA or Ed25519, got %T", k.ID, public)
+		}
+		keys.keys = append(keys.keys, key)
+	}
+	sort.SliceStable(keys.keys, func(i, j int) bool {
+		return keys.keys[i].ActiveFrom.Before(keys.keys[j].ActiveFrom)
+	})
+
+	if _, ok := keys.signingKey(now); !ok {
+		return nil, errors.New("no private key is active yet")
+	}
+	return keys, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return block, nil
+}
+
+// readPrivateKey reads a PEM encoded PKCS #8 key, or an RSA key in PKCS #1
+// form.
+func readPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key %T", parsed)
+	}
+	return key, nil
+}
+
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// signingKey returns the private key that became active last.
+func (k *JWTKeys) signingKey(now time.Time) (JWTKey, bool) {
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		key := k.keys[i]
+		if key.Private != nil && !key.ActiveFrom.After(now) {
+			return key, true
+		}
+	}
+	return JWTKey{}, false
+}
+
+// MakeJWT returns an access token signed with the current key.
+func (k *JWTKeys) MakeJWT(accessToken AccessToken, expiresIn time.Duration) (string, error) {
+	if len(k.keys) == 0 {
+		return MakeJWT(accessToken, k.secret, expiresIn)
+	}
+
+	now := time.Now().UTC()
+	key, ok := k.signingKey(now)
+	if !ok {
+		return "", errors.New("no active signing key")
+	}
+	token := jwt.NewWithClaims(key.Method, newAccessTokenClaims(accessToken, now, expiresIn))
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// ValidateJWT checks an access token against the key its kid names, or the
+// HS256 secret for tokens without one.
+func (k *JWTKeys) ValidateJWT(tokenString string) (AccessToken, error) {
+	claimsStruct := accessTokenClaims{}
+	token, err := jwt.ParseWithClaims(
+		tokenString,
+		&claimsStruct,
+		k.keyFunc,
+		jwt.WithValidMethods([]string{
+			jwt.SigningMethodHS256.Alg(),
+			jwt.SigningMethodRS256.Alg(),
+			jwt.SigningMethodEdDSA.Alg(),
+		}),
+	)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	return claimsStruct.accessToken(token)
+}
+
+func (k *JWTKeys) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		// Only HS256 tokens go without a kid, and only the secret verifies
+		// them, so a public key can never be used as an HMAC secret
+		if k.secret == "" || token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+			return nil, errors.New("token has no kid")
+		}
+		return []byte(k.secret), nil
+	}
+	for _, key := range k.keys {
+		if key.ID != kid {
+			continue
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("key %q doesn't sign %s tokens", kid, token.Method.Alg())
+		}
+		return key.Public, nil
+	}
+	return nil, fmt.Errorf("unknown kid %q", kid)
+}
+
+// JWK is a public key in JSON Web Key form.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS returns the public keys tokens may be signed with, including keys
+// that aren't active yet.
+func (k *JWTKeys) JWKS() []JWK {
+	jwks := []JWK{}
+	for _, key := range k.keys {
+		jwk := JWK{
+			ID:        key.ID,
+			Use:       "sig",
+			Algorithm: key.Method.Alg(),
+		}
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
@@ -0,0 +1,406 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+type testKey struct {
+	id         string
+	private    crypto.Signer
+	publicOnly bool
+	activeFrom time.Time
+}
+
+func newRSAKey(t *testing.T, bits int) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+	return key
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating Ed25519 key: %v", err)
+	}
+	return key
+}
+
+// writeKeysFile writes the keys and a keys file listing them to a temp dir
+// and returns the path of the keys file.
+func writeKeysFile(t *testing.T, keys []testKey) string {
+	t.Helper()
+	dir := t.TempDir()
+
+	type fileKey struct {
+		ID             string    `json:"kid"`
+		PrivateKeyFile string    `json:"private_key_file,omitempty"`
+		PublicKeyFile  string    `json:"public_key_file,omitempty"`
+		ActiveFrom     time.Time `json:"active_from"`
+	}
+	file := struct {
+		Keys []fileKey `json:"keys"`
+	}{}
+	for i, key := range keys {
+		entry := fileKey{ID: key.id, ActiveFrom: key.activeFrom}
+		var block *pem.Block
+		if key.publicOnly {
+			der, err := x509.MarshalPKIXPublicKey(key.private.Public())
+			if err != nil {
+				t.Fatalf("marshaling public key: %v", err)
+			}
+			block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+			entry.PublicKeyFile = fmt.Sprintf("key-%d.pub.pem", i)
+		} else {
+			der, err := x509.MarshalPKCS8PrivateKey(key.private)
+			if err != nil {
+				t.Fatalf("marshaling private key: %v", err)
+			}
+			block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+			entry.PrivateKeyFile = fmt.Sprintf("key-%d.pem", i)
+		}
+		name := entry.PrivateKeyFile + entry.PublicKeyFile
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		file.Keys = append(file.Keys, entry)
+	}
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "keys.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadTestKeys(t *testing.T, keys []testKey, hmacSecret string, now time.Time) *JWTKeys {
+	t.Helper()
+	jwtKeys, err := LoadJWTKeys(writeKeysFile(t, keys), hmacSecret, now)
+	if err != nil {
+		t.Fatalf("LoadJWTKeys: %v", err)
+	}
+	return jwtKeys
+}
+
+// signTestToken signs an access token for userID by hand, with kid unless
+// it's empty.
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, key any, userID uuid.UUID) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, newAccessTokenClaims(AccessToken{UserID: userID}, time.Now(), time.Hour))
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	return signed
+}
+
+func TestJWTKeysRoundTrip(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		key     crypto.Signer
+		wantAlg string
+	}{
+		{name: "RS256", key: newRSAKey(t, 2048), wantAlg: "RS256"},
+		{name: "EdDSA", key: newEd25519Key(t), wantAlg: "EdDSA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := loadTestKeys(t, []testKey{{id: "key-1", private: tt.key, activeFrom: now.Add(-time.Hour)}}, "", now)
+
+			want := AccessToken{UserID: uuid.New(), Generation: 3, SessionID: uuid.New()}
+			token, err := keys.MakeJWT(want, time.Hour)
+			if err != nil {
+				t.Fatalf("MakeJWT: %v", err)
+			}
+
+			parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+			if err != nil {
+				t.Fatalf("parsing token: %v", err)
+			}
+			if kid := parsed.Header["kid"]; kid != "key-1" {
+				t.Errorf("kid = %v, want key-1", kid)
+			}
+			if alg := parsed.Method.Alg(); alg != tt.wantAlg {
+				t.Errorf("alg = %s, want %s", alg, tt.wantAlg)
+			}
+
+			got, err := keys.ValidateJWT(token)
+			if err != nil {
+				t.Fatalf("ValidateJWT: %v", err)
+			}
+			if got != want {
+				t.Errorf("ValidateJWT = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestJWTKeysValidateJWT(t *testing.T) {
+	now := time.Now()
+	rsaKey := newRSAKey(t, 2048)
+	edKey := newEd25519Key(t)
+	otherKey := newRSAKey(t, 2048)
+	keys := []testKey{
+		{id: "rsa", private: rsaKey, activeFrom: now.Add(-time.Hour)},
+		{id: "ed", private: edKey, activeFrom: now.Add(-2 * time.Hour)},
+	}
+	withoutSecret := loadTestKeys(t, keys, "", now)
+	withSecret := loadTestKeys(t, keys, "hmac-secret", now)
+
+	publicPEM, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("marshaling public key: %v", err)
+	}
+	publicPEM = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicPEM})
+
+	userID := uuid.New()
+	tests := []struct {
+		name    string
+		keys    *JWTKeys
+		token   string
+		wantErr bool
+	}{
+		{
+			name:  "RS256 with its kid",
+			keys:  withoutSecret,
+			token: signTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, userID),
+		},
+		{
+			name:  "EdDSA with its kid",
+			keys:  withoutSecret,
+			token: signTestToken(t, jwt.SigningMethodEdDSA, "ed", edKey, userID),
+		},
+		{
+			name:    "unknown kid",
+			keys:    withoutSecret,
+			token:   signTestToken(t, jwt.SigningMethodRS256, "other", otherKey, userID),
+			wantErr: true,
+		},
+		{
+			name:    "kid of another key",
+			keys:    withoutSecret,
+			token:   signTestToken(t, jwt.SigningMethodRS256, "rsa", otherKey, userID),
+			wantErr: true,
+		},
+		{
+			name:    "alg not matching the kid",
+			keys:    withoutSecret,
+			token:   signTestToken(t, jwt.SigningMethodEdDSA, "rsa", edKey, userID),
+			wantErr: true,
+		},
+		{
+			name:    "HS256 without a kid and no secret",
+			keys:    withoutSecret,
+			token:   signTestToken(t, jwt.SigningMethodHS256, "", []byte("hmac-secret"), userID),
+			wantErr: true,
+		},
+		{
+			name:  "HS256 without a kid with the secret",
+			keys:  withSecret,
+			token: signTestToken(t, jwt.SigningMethodHS256, "", []byte("hmac-secret"), userID),
+		},
+		{
+			name:    "HS256 with the wrong secret",
+			keys:    withSecret,
+			token:   signTestToken(t, jwt.SigningMethodHS256, "", []byte("guessed"), userID),
+			wantErr: true,
+		},
+		{
+			name:    "HS256 forged with the public key and its kid",
+			keys:    withSecret,
+			token:   signTestToken(t, jwt.SigningMethodHS256, "rsa", publicPEM, userID),
+			wantErr: true,
+		},
+		{
+			name:    "HS256 forged with the public key without a kid",
+			keys:    withSecret,
+			token:   signTestToken(t, jwt.SigningMethodHS256, "", publicPEM, userID),
+			wantErr: true,
+		},
+		{
+			name:    "unsigned",
+			keys:    withSecret,
+			token:   signTestToken(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, userID),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.keys.ValidateJWT(tt.token)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ValidateJWT accepted the token for %v", got.UserID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ValidateJWT: %v", err)
+			}
+			if got.UserID != userID {
+				t.Errorf("user ID = %v, want %v", got.UserID, userID)
+			}
+		})
+	}
+}
+
+func TestJWTKeysSigningKey(t *testing.T) {
+	now := time.Now()
+	keys := loadTestKeys(t, []testKey{
+		// Listed out of order, with the next key published ahead of time
+		{id: "next", private: newEd25519Key(t), activeFrom: now.Add(24 * time.Hour)},
+		{id: "current", private: newEd25519Key(t), activeFrom: now.Add(-time.Hour)},
+		{id: "old", private: newRSAKey(t, 2048), activeFrom: now.Add(-48 * time.Hour)},
+		// A newer key without its private half only verifies
+		{id: "verify-only", private: newEd25519Key(t), publicOnly: true, activeFrom: now.Add(-time.Minute)},
+	}, "", now)
+
+	tests := []struct {
+		at      time.Time
+		wantKid string
+	}{
+		{at: now.Add(-24 * time.Hour), wantKid: "old"},
+		{at: now, wantKid: "current"},
+		{at: now.Add(25 * time.Hour), wantKid: "next"},
+	}
+	for _, tt := range tests {
+		key, ok := keys.signingKey(tt.at)
+		if !ok || key.ID != tt.wantKid {
+			t.Errorf("signing key at %v is %q, want %q", tt.at, key.ID, tt.wantKid)
+		}
+	}
+
+	token, err := keys.MakeJWT(AccessToken{UserID: uuid.New()}, time.Hour)
+	if err != nil {
+		t.Fatalf("MakeJWT: %v", err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatalf("parsing token: %v", err)
+	}
+	if kid := parsed.Header["kid"]; kid != "current" {
+		t.Errorf("MakeJWT signed with %v, want current", kid)
+	}
+}
+
+func TestLoadJWTKeysRejects(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	key := newEd25519Key(t)
+
+	tests := []struct {
+		name string
+		keys []testKey
+	}{
+		{
+			name: "RSA key under 2048 bits",
+			keys: []testKey{{id: "small", private: newRSAKey(t, 1024), activeFrom: past}},
+		},
+		{
+			name: "duplicate kid",
+			keys: []testKey{
+				{id: "key", private: key, activeFrom: past},
+				{id: "key", private: newEd25519Key(t), activeFrom: past},
+			},
+		},
+		{
+			name: "empty kid",
+			keys: []testKey{{id: "", private: key, activeFrom: past}},
+		},
+		{
+			name: "no private key active yet",
+			keys: []testKey{{id: "next", private: key, activeFrom: now.Add(time.Hour)}},
+		},
+		{
+			name: "only public keys",
+			keys: []testKey{{id: "public", private: key, publicOnly: true, activeFrom: past}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadJWTKeys(writeKeysFile(t, tt.keys), "", now); err == nil {
+				t.Error("LoadJWTKeys accepted the keys")
+			}
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	now := time.Now()
+	rsaKey := newRSAKey(t, 2048)
+	edKey := newEd25519Key(t)
+	keys := loadTestKeys(t, []testKey{
+		{id: "rsa", private: rsaKey, activeFrom: now.Add(-time.Hour)},
+		{id: "ed", private: edKey, activeFrom: now.Add(time.Hour)},
+	}, "", now)
+
+	jwks := map[string]JWK{}
+	for _, jwk := range keys.JWKS() {
+		jwks[jwk.ID] = jwk
+	}
+	if len(jwks) != 2 {
+		t.Fatalf("JWKS has %d keys, want 2", len(jwks))
+	}
+
+	decode := func(s string) []byte {
+		t.Helper()
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatalf("decoding %q: %v", s, err)
+		}
+		return data
+	}
+
+	t.Run("RSA", func(t *testing.T) {
+		jwk := jwks["rsa"]
+		if jwk.KeyType != "RSA" || jwk.Algorithm != "RS256" || jwk.Use != "sig" {
+			t.Errorf("JWK = %+v, want an RS256 signing key", jwk)
+		}
+		if n := new(big.Int).SetBytes(decode(jwk.N)); n.Cmp(rsaKey.N) != 0 {
+			t.Error("n doesn't decode to the modulus")
+		}
+		// 65537 is AQAB in every JWKS
+		if jwk.E != "AQAB" {
+			t.Errorf("e = %q, want AQAB", jwk.E)
+		}
+	})
+
+	t.Run("Ed25519", func(t *testing.T) {
+		jwk := jwks["ed"]
+		if jwk.KeyType != "OKP" || jwk.Curve != "Ed25519" || jwk.Algorithm != "EdDSA" {
+			t.Errorf("JWK = %+v, want an Ed25519 key", jwk)
+		}
+		if x := decode(jwk.X); !edKey.Public().(ed25519.PublicKey).Equal(ed25519.PublicKey(x)) {
+			t.Error("x doesn't decode to the public key")
+		}
+		if jwk.N != "" || jwk.E != "" {
+			t.Errorf("Ed25519 JWK has RSA fields: %+v", jwk)
+		}
+	})
+}
@@ -0,0 +1,237 @@
+// Package cloudfront signs URLs and cookies for private CloudFront
+// distributions. Signing is done locally with the RSA key of a CloudFront key
+// pair, no AWS calls are made.
+package cloudfront
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Signer signs with the private key of a CloudFront key pair.
+type Signer struct {
+	keyPairID string
+	key       *rsa.PrivateKey
+}
+
+func NewSigner(keyPairID string, key *rsa.PrivateKey) *Signer {
+	return &Signer{keyPairID: keyPairID, key: key}
+}
+
+// ParsePrivateKey reads a PEM encoded RSA key in PKCS #1 or PKCS #8 form.
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("CloudFront keys must be RSA, got %T", parsed)
+	}
+	return key, nil
+}
+
+// Policy is a custom policy. Resource may end in a * to cover a prefix.
+// Zero NotBefore and empty IPAddress leave those conditions out.
+type Policy struct {
+	Resource  string
+	Expires   time.Time
+	NotBefore time.Time
+	// IPAddress is a CIDR range the request has to come from
+	IPAddress string
+}
+
+type epochTime struct {
+	EpochTime int64 `json:"AWS:EpochTime"`
+}
+
+type sourceIP struct {
+	SourceIP string `json:"AWS:SourceIp"`
+}
+
+type policyDocument struct {
+	Statement []policyStatement `json:"Statement"`
+}
+
+type policyStatement struct {
+	Resource  string `json:"Resource"`
+	Condition struct {
+		DateLessThan    epochTime  `json:"DateLessThan"`
+		DateGreaterThan *epochTime `json:"DateGreaterThan,omitempty"`
+		IPAddress       *sourceIP  `json:"IpAddress,omitempty"`
+	} `json:"Condition"`
+}
+
+func (p Policy) document() ([]byte, error) {
+	statement := policyStatement{Resource: p.Resource}
+	statement.Condition.DateLessThan.EpochTime = p.Expires.Unix()
+	if !p.NotBefore.IsZero() {
+		statement.Condition.DateGreaterThan = &epochTime{EpochTime: p.NotBefore.Unix()}
+	}
+	if p.IPAddress != "" {
+		statement.Condition.IPAddress = &sourceIP{SourceIP: p.IPAddress}
+	}
+
+	// URLs must not be HTML escaped, CloudFront compares them verbatim
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(policyDocument{Statement: []policyStatement{statement}}); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(buf.Bytes()), nil
+}
+
+// CannedPolicy is the policy CloudFront rebuilds from a URL signed with a
+// canned policy, byte for byte.
+func CannedPolicy(resource string, expires time.Time) []byte {
+	return []byte(fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`, resource, expires.Unix()))
+}
+
+// SignURL signs rawURL with a canned policy valid until expires.
+func (s *Signer) SignURL(rawURL string, expires time.Time) (string, error) {
+	signature, err := s.sign(CannedPolicy(rawURL, expires))
+	if err != nil {
+		return "", err
+	}
+	return appendQuery(rawURL, url.Values{
+		"Expires":     {fmt.Sprint(expires.Unix())},
+		"Signature":   {signature},
+		"Key-Pair-Id": {s.keyPairID},
+	})
+}
+
+// SignURLWithPolicy signs rawURL with a custom policy. An empty
+// policy.Resource is set to rawURL.
+func (s *Signer) SignURLWithPolicy(rawURL string, policy Policy) (string, error) {
+	if policy.Resource == "" {
+		policy.Resource = rawURL
+	}
+	document, err := policy.document()
+	if err != nil {
+		return "", err
+	}
+	signature, err := s.sign(document)
+	if err != nil {
+		return "", err
+	}
+	return appendQuery(rawURL, url.Values{
+		"Policy":      {encode(document)},
+		"Signature":   {signature},
+		"Key-Pair-Id": {s.keyPairID},
+	})
+}
+
+// Cookies returns the signed cookies granting access to policy.Resource.
+// The caller sets the domain, path and attributes that fit its setup.
+func (s *Signer) Cookies(policy Policy) ([]*http.Cookie, error) {
+	document, err := policy.document()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := s.sign(document)
+	if err != nil {
+		return nil, err
+	}
+	return []*http.Cookie{
+		{Name: "CloudFront-Policy", Value: encode(document)},
+		{Name: "CloudFront-Signature", Value: signature},
+		{Name: "CloudFront-Key-Pair-Id", Value: s.keyPairID},
+	}, nil
+}
+
+// sign returns the CloudFront encoded RSA-SHA1 signature of policy, the
+// only algorithm CloudFront accepts for key pairs.
+func (s *Signer) sign(policy []byte) (string, error) {
+	hash := sha1.Sum(policy)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return encode(signature), nil
+}
+
+// ErrPolicyExpired is returned by Verify for policies outside their time
+// window.
+var ErrPolicyExpired = errors.New("policy has expired or isn't valid yet")
+
+// Verify checks a signature against the policy it should cover, see
+// CannedPolicy and DecodePolicy, and that the policy is in effect at now.
+// CloudFront does this on every request, it is here to check a key pair and
+// configuration offline. IP conditions aren't checked.
+func Verify(publicKey *rsa.PublicKey, policy []byte, signature string, now time.Time) error {
+	raw, err := decode(signature)
+	if err != nil {
+		return err
+	}
+	hash := sha1.Sum(policy)
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA1, hash[:], raw); err != nil {
+		return err
+	}
+
+	var document policyDocument
+	if err := json.Unmarshal(policy, &document); err != nil {
+		return fmt.Errorf("invalid policy: %w", err)
+	}
+	if len(document.Statement) != 1 {
+		return errors.New("policy must have exactly one statement")
+	}
+	condition := document.Statement[0].Condition
+	if !now.Before(time.Unix(condition.DateLessThan.EpochTime, 0)) {
+		return ErrPolicyExpired
+	}
+	if condition.DateGreaterThan != nil && !now.After(time.Unix(condition.DateGreaterThan.EpochTime, 0)) {
+		return ErrPolicyExpired
+	}
+	return nil
+}
+
+// DecodePolicy decodes the Policy parameter or cookie of a custom policy,
+// for Verify.
+func DecodePolicy(policy string) ([]byte, error) {
+	return decode(policy)
+}
+
+// CloudFront uses base64 with characters that are safe in URLs and cookies
+var cloudFrontEncoding = strings.NewReplacer("+", "-", "=", "_", "/", "~")
+var cloudFrontDecoding = strings.NewReplacer("-", "+", "_", "=", "~", "/")
+
+func encode(data []byte) string {
+	return cloudFrontEncoding.Replace(base64.StdEncoding.EncodeToString(data))
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(cloudFrontDecoding.Replace(s))
+}
+
+func appendQuery(rawURL string, params url.Values) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	separator := "?"
+	if u.RawQuery != "" {
+		separator = "&"
+	}
+	return rawURL + separator + params.Encode(), nil
+}
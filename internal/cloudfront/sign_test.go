@@ -0,0 +1,283 @@
+package cloudfront
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKeyPairID = "K2JCJMDEHXQW5F"
+
+func newTestSigner(t *testing.T) (*Signer, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	return NewSigner(testKeyPairID, key), key
+}
+
+// signedParams splits a signed URL into the URL that was signed and its
+// signing parameters.
+func signedParams(t *testing.T, signedURL string) (string, url.Values) {
+	t.Helper()
+	rawURL, rawQuery, ok := strings.Cut(signedURL, "?")
+	if !ok {
+		t.Fatalf("%s has no query", signedURL)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		t.Fatalf("parsing query of %s: %v", signedURL, err)
+	}
+	// Keep the query the URL had before signing
+	params := url.Values{}
+	for _, name := range []string{"Expires", "Policy", "Signature", "Key-Pair-Id"} {
+		if value, ok := query[name]; ok {
+			params[name] = value
+			query.Del(name)
+		}
+	}
+	if len(query) > 0 {
+		rawURL += "?" + query.Encode()
+	}
+	return rawURL, params
+}
+
+func TestSignURLCanned(t *testing.T) {
+	signer, key := newTestSigner(t)
+	now := time.Now()
+	expires := now.Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		rawURL string
+	}{
+		{name: "no query", rawURL: "https://d111111abcdef8.cloudfront.net/videos/a.mp4"},
+		{name: "with query", rawURL: "https://d111111abcdef8.cloudfront.net/videos/a.mp4?width=320"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signedURL, err := signer.SignURL(tt.rawURL, expires)
+			if err != nil {
+				t.Fatalf("SignURL: %v", err)
+			}
+			rawURL, params := signedParams(t, signedURL)
+			if rawURL != tt.rawURL {
+				t.Errorf("signed URL starts with %q, want %q", rawURL, tt.rawURL)
+			}
+			if got := params.Get("Key-Pair-Id"); got != testKeyPairID {
+				t.Errorf("Key-Pair-Id = %q, want %q", got, testKeyPairID)
+			}
+			if got := params.Get("Expires"); got != strconv.FormatInt(expires.Unix(), 10) {
+				t.Errorf("Expires = %q, want %d", got, expires.Unix())
+			}
+
+			policy := CannedPolicy(rawURL, expires)
+			if err := Verify(&key.PublicKey, policy, params.Get("Signature"), now); err != nil {
+				t.Errorf("Verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestSignURLWithPolicy(t *testing.T) {
+	signer, key := newTestSigner(t)
+	now := time.Now()
+	rawURL := "https://d111111abcdef8.cloudfront.net/videos/landscape/abc/hls/master.m3u8"
+
+	tests := []struct {
+		name   string
+		policy Policy
+		want   string
+	}{
+		{
+			name:   "resource defaults to the URL",
+			policy: Policy{Expires: now.Add(time.Hour)},
+			want:   `"Resource":"` + rawURL + `"`,
+		},
+		{
+			name: "prefix with all conditions",
+			policy: Policy{
+				Resource:  "https://d111111abcdef8.cloudfront.net/videos/landscape/abc/*",
+				Expires:   now.Add(time.Hour),
+				NotBefore: now.Add(-time.Minute),
+				IPAddress: "192.0.2.0/24",
+			},
+			want: `"IpAddress":{"AWS:SourceIp":"192.0.2.0/24"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signedURL, err := signer.SignURLWithPolicy(rawURL, tt.policy)
+			if err != nil {
+				t.Fatalf("SignURLWithPolicy: %v", err)
+			}
+			_, params := signedParams(t, signedURL)
+			if params.Has("Expires") {
+				t.Errorf("custom policy URL has Expires")
+			}
+
+			policy, err := DecodePolicy(params.Get("Policy"))
+			if err != nil {
+				t.Fatalf("DecodePolicy: %v", err)
+			}
+			if !strings.Contains(string(policy), tt.want) {
+				t.Errorf("policy %s doesn't contain %s", policy, tt.want)
+			}
+			if err := Verify(&key.PublicKey, policy, params.Get("Signature"), now); err != nil {
+				t.Errorf("Verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestCookies(t *testing.T) {
+	signer, key := newTestSigner(t)
+	now := time.Now()
+
+	cookies, err := signer.Cookies(Policy{
+		Resource: "https://d111111abcdef8.cloudfront.net/videos/*",
+		Expires:  now.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("Cookies: %v", err)
+	}
+	values := map[string]string{}
+	for _, cookie := range cookies {
+		values[cookie.Name] = cookie.Value
+	}
+	if got := values["CloudFront-Key-Pair-Id"]; got != testKeyPairID {
+		t.Errorf("CloudFront-Key-Pair-Id = %q, want %q", got, testKeyPairID)
+	}
+
+	policy, err := DecodePolicy(values["CloudFront-Policy"])
+	if err != nil {
+		t.Fatalf("DecodePolicy: %v", err)
+	}
+	if err := Verify(&key.PublicKey, policy, values["CloudFront-Signature"], now); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	signer, key := newTestSigner(t)
+	_, otherKey := newTestSigner(t)
+	now := time.Now()
+	resource := "https://d111111abcdef8.cloudfront.net/videos/a.mp4"
+
+	sign := func(policy []byte) string {
+		signature, err := signer.sign(policy)
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		return signature
+	}
+	document := func(policy Policy) []byte {
+		data, err := policy.document()
+		if err != nil {
+			t.Fatalf("document: %v", err)
+		}
+		return data
+	}
+
+	valid := CannedPolicy(resource, now.Add(time.Hour))
+	tampered := CannedPolicy(resource+"*", now.Add(time.Hour))
+	expired := CannedPolicy(resource, now.Add(-time.Second))
+	notYetValid := document(Policy{
+		Resource:  resource,
+		Expires:   now.Add(2 * time.Hour),
+		NotBefore: now.Add(time.Hour),
+	})
+
+	tests := []struct {
+		name      string
+		publicKey *rsa.PublicKey
+		policy    []byte
+		signature string
+		wantErr   error
+	}{
+		{
+			name:      "tampered policy",
+			publicKey: &key.PublicKey,
+			policy:    tampered,
+			signature: sign(valid),
+			wantErr:   rsa.ErrVerification,
+		},
+		{
+			name:      "other key",
+			publicKey: &otherKey.PublicKey,
+			policy:    valid,
+			signature: sign(valid),
+			wantErr:   rsa.ErrVerification,
+		},
+		{
+			name:      "expired",
+			publicKey: &key.PublicKey,
+			policy:    expired,
+			signature: sign(expired),
+			wantErr:   ErrPolicyExpired,
+		},
+		{
+			name:      "not valid yet",
+			publicKey: &key.PublicKey,
+			policy:    notYetValid,
+			signature: sign(notYetValid),
+			wantErr:   ErrPolicyExpired,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.publicKey, tt.policy, tt.signature, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("malformed signature", func(t *testing.T) {
+		if err := Verify(&key.PublicKey, valid, "not base64!", now); err == nil {
+			t.Error("Verify accepted a malformed signature")
+		}
+	})
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshaling key: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		block *pem.Block
+	}{
+		{name: "PKCS #1", block: &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}},
+		{name: "PKCS #8", block: &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParsePrivateKey(pem.EncodeToMemory(tt.block))
+			if err != nil {
+				t.Fatalf("ParsePrivateKey: %v", err)
+			}
+			if !parsed.Equal(key) {
+				t.Error("parsed key differs")
+			}
+		})
+	}
+
+	if _, err := ParsePrivateKey([]byte("not a key")); err == nil {
+		t.Error("ParsePrivateKey accepted data without a PEM block")
+	}
+}
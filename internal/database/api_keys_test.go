@@ -0,0 +1,124 @@
+package database
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestAPIKeys(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		c := newTestClient(t, dsn)
+		user := createTestUser(t, c)
+		other := createTestUser(t, c)
+
+		createKey := func(userID uuid.UUID, hash string, scopes ...string) APIKey {
+			t.Helper()
+			key, err := c.CreateAPIKey(CreateAPIKeyParams{
+				UserID:  userID,
+				Name:    "ci",
+				Prefix:  "tubely_" + hash[:8],
+				KeyHash: hash,
+				Scopes:  scopes,
+			})
+			if err != nil {
+				t.Fatalf("CreateAPIKey: %v", err)
+			}
+			return key
+		}
+		readKey := createKey(user.ID, "hash-read-only", "videos:read")
+		writeKey := createKey(user.ID, "hash-read-write", "videos:read", "videos:write")
+		createKey(other.ID, "hash-other-user", "videos:read")
+
+		tests := []struct {
+			name       string
+			hash       string
+			wantID     uuid.UUID
+			wantScopes []string
+		}{
+			{name: "read key", hash: "hash-read-only", wantID: readKey.ID, wantScopes: []string{"videos:read"}},
+			{name: "write key", hash: "hash-read-write", wantID: writeKey.ID, wantScopes: []string{"videos:read", "videos:write"}},
+			{name: "unknown hash", hash: "hash-unknown", wantID: uuid.Nil},
+		}
+		for _, tt := range tests {
+			key, err := c.GetAPIKeyByHash(tt.hash)
+			if err != nil {
+				t.Fatalf("%s: GetAPIKeyByHash: %v", tt.name, err)
+			}
+			if key.ID != tt.wantID {
+				t.Errorf("%s: got key %v, want %v", tt.name, key.ID, tt.wantID)
+			}
+			if tt.wantID == uuid.Nil {
+				continue
+			}
+			if !slices.Equal(key.Scopes, tt.wantScopes) {
+				t.Errorf("%s: scopes %v, want %v", tt.name, key.Scopes, tt.wantScopes)
+			}
+			if key.UserID != user.ID || key.RevokedAt != nil || key.LastUsedAt != nil {
+				t.Errorf("%s: new key is %+v", tt.name, key)
+			}
+		}
+
+		keys, err := c.GetAPIKeys(user.ID)
+		if err != nil {
+			t.Fatalf("GetAPIKeys: %v", err)
+		}
+		if len(keys) != 2 {
+			t.Errorf("user has %d keys, want 2", len(keys))
+		}
+
+		if err := c.RevokeAPIKey(readKey.ID); err != nil {
+			t.Fatalf("RevokeAPIKey: %v", err)
+		}
+		revoked, err := c.GetAPIKeyByHash("hash-read-only")
+		if err != nil {
+			t.Fatalf("GetAPIKeyByHash: %v", err)
+		}
+		if revoked.RevokedAt == nil {
+			t.Error("revoked key has no revoked_at")
+		}
+	})
+}
+
+func TestTouchAPIKey(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		c := newTestClient(t, dsn)
+		key, err := c.CreateAPIKey(CreateAPIKeyParams{
+			UserID:  createTestUser(t, c).ID,
+			Name:    "ci",
+			Prefix:  "tubely_12345678",
+			KeyHash: "hash",
+			Scopes:  []string{"videos:read"},
+		})
+		if err != nil {
+			t.Fatalf("CreateAPIKey: %v", err)
+		}
+		now := time.Now()
+
+		// Each step uses the key at its time
+		steps := []struct {
+			name         string
+			at           time.Time
+			wantLastUsed time.Time
+		}{
+			{name: "first use", at: now, wantLastUsed: now},
+			{name: "within the resolution", at: now.Add(30 * time.Second), wantLastUsed: now},
+			{name: "after the resolution", at: now.Add(2 * time.Minute), wantLastUsed: now.Add(2 * time.Minute)},
+		}
+		for _, step := range steps {
+			if err := c.TouchAPIKey(key.ID, step.at, time.Minute); err != nil {
+				t.Fatalf("%s: TouchAPIKey: %v", step.name, err)
+			}
+			got, err := c.GetAPIKey(key.ID)
+			if err != nil {
+				t.Fatalf("%s: GetAPIKey: %v", step.name, err)
+			}
+			// Postgres keeps microseconds
+			if got.LastUsedAt == nil || got.LastUsedAt.Sub(step.wantLastUsed).Abs() > time.Millisecond {
+				t.Errorf("%s: last used %v, want %v", step.name, got.LastUsedAt, step.wantLastUsed)
+			}
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Tests run against SQLite, and against Postgres too when TEST_DB_URL is a
+// postgres:// URL. Every Postgres test gets a schema of its own.
+
+const testDBURLEnv = "TEST_DB_URL"
+
+// forEachDialect runs fn as a subtest per dialect, each with the connection
+// string of an empty database of its own.
+func forEachDialect(t *testing.T, fn func(t *testing.T, dsn string)) {
+	t.Helper()
+	for _, d := range []dialect{dialectSQLite, dialectPostgres} {
+		t.Run(d.String(), func(t *testing.T) {
+			fn(t, testDSN(t, d))
+		})
+	}
+}
+
+// openTestClient opens the database without migrating it.
+func openTestClient(t *testing.T, dsn string) Client {
+	t.Helper()
+	c, err := Open(dsn)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// newTestClient opens the database with every migration applied.
+func newTestClient(t *testing.T, dsn string) Client {
+	t.Helper()
+	c := openTestClient(t, dsn)
+	if _, err := c.MigrateUp(); err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	return c
+}
+
+// testDSN returns the connection string of an empty database, skipping the
+// test if the dialect isn't available.
+func testDSN(t *testing.T, d dialect) string {
+	t.Helper()
+	if d == dialectSQLite {
+		return filepath.Join(t.TempDir(), "tubely.db")
+	}
+
+	baseURL := os.Getenv(testDBURLEnv)
+	if baseURL == "" {
+		t.Skipf("%s isn't set", testDBURLEnv)
+	}
+	if parsed, _ := parseDSN(baseURL); parsed != dialectPostgres {
+		t.Skipf("%s isn't a postgres:// URL", testDBURLEnv)
+	}
+
+	db, err := sql.Open("postgres", baseURL)
+	if err != nil {
+		t.Fatalf("opening %s: %v", testDBURLEnv, err)
+	}
+	defer db.Close()
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		t.Fatal(err)
+	}
+	schema := "test_" + hex.EncodeToString(suffix)
+	if _, err := db.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("creating schema: %v", err)
+	}
+	t.Cleanup(func() {
+		db, err := sql.Open("postgres", baseURL)
+		if err != nil {
+			t.Errorf("opening %s: %v", testDBURLEnv, err)
+			return
+		}
+		defer db.Close()
+		if _, err := db.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("dropping schema: %v", err)
+		}
+	})
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", testDBURLEnv, err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func createTestUser(t *testing.T, c Client) User {
+	t.Helper()
+	user, err := c.CreateUser(CreateUserParams{
+		Email:    uuid.NewString() + "@example.com",
+		Password: "hash",
+	})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	return *user
+}
+
+func createTestVideo(t *testing.T, c Client, userID uuid.UUID) Video {
+	t.Helper()
+	video, err := c.CreateVideo(CreateVideoParams{
+		Title:  "Boots",
+		UserID: userID,
+	})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	return video
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"database/sql"
+	"net/url"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type dialect int
+
+const (
+	dialectSQLite dialect = iota
+	dialectPostgres
+)
+
+func (d dialect) String() string {
+	switch d {
+	case dialectPostgres:
+		return "postgres"
+	default:
+		return "sqlite3"
+	}
+}
+
+// parseDSN picks the dialect from the connection string. postgres:// and
+// postgresql:// URLs select Postgres, anything else is a SQLite file path.
+func parseDSN(dsn string) (dialect, string) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return dialectPostgres, dsn
+	}
+	return dialectSQLite, sqliteDSN(strings.TrimPrefix(dsn, "sqlite://"))
+}
+
+// sqliteBusyTimeout is how long, in milliseconds, a SQLite connection waits
+// for another one to release the database.
+const sqliteBusyTimeout = 5000
+
+// sqliteDSN adds the settings concurrent access needs to a SQLite DSN,
+// unless it sets them itself. Job workers write while request handlers
+// read and write: in WAL mode readers don't block on a writer, and the
+// busy timeout makes writers wait their turn instead of failing with
+// "database is locked".
+//
+// Foreign keys stay off, as is SQLite's default. SQLite migrations change
+// tables by rebuilding them (see migration 2), and dropping a parent table
+// with foreign keys on deletes its children. Deletes remove child rows
+// themselves instead, see DeleteVideoWithJob.
+func sqliteDSN(dsn string) string {
+	_, rawQuery, hasQuery := strings.Cut(dsn, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// Leave it to the driver to report
+		return dsn
+	}
+
+	// The driver accepts a short alias of each
+	params := []string{}
+	if !query.Has("_busy_timeout") && !query.Has("_timeout") {
+		params = append(params, "_busy_timeout="+strconv.Itoa(sqliteBusyTimeout))
+	}
+	if !query.Has("_journal_mode") && !query.Has("_journal") {
+		params = append(params, "_journal_mode=WAL")
+	}
+	if len(params) == 0 {
+		return dsn
+	}
+	separator := "?"
+	if hasQuery {
+		separator = "&"
+	}
+	return dsn + separator + strings.Join(params, "&")
+}
+
+// rebind rewrites ? placeholders into the dialect's bind syntax. Queries are
+// written with ? and must not contain a literal question mark.
+func (d dialect) rebind(query string) string {
+	if d != dialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (c Client) exec(query string, args ...any) (sql.Result, error) {
+	return c.db.Exec(c.dialect.rebind(query), args...)
+}
+
+func (c Client) query(query string, args ...any) (*sql.Rows, error) {
+	return c.db.Query(c.dialect.rebind(query), args...)
+}
+
+func (c Client) queryRow(query string, args ...any) *sql.Row {
+	return c.db.QueryRow(c.dialect.rebind(query), args...)
+}
+
+// tx wraps a transaction so queries inside it are rebound like the Client's.
+type tx struct {
+	tx      *sql.Tx
+	dialect dialect
+}
+
+func (t tx) exec(query string, args ...any) (sql.Result, error) {
+	return t.tx.Exec(t.dialect.rebind(query), args...)
+}
+
+func (t tx) query(query string, args ...any) (*sql.Rows, error) {
+	return t.tx.Query(t.dialect.rebind(query), args...)
+}
+
+func (t tx) queryRow(query string, args ...any) *sql.Row {
+	return t.tx.QueryRow(t.dialect.rebind(query), args...)
+}
+
+func (c Client) inTx(fn func(t tx) error) error {
+	sqlTx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx{tx: sqlTx, dialect: c.dialect}); err != nil {
+		sqlTx.Rollback()
+		return err
+	}
+	return sqlTx.Commit()
+}
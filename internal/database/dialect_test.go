@@ -0,0 +1,82 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseDSN(t *testing.T) {
+	tests := []struct {
+		name        string
+		dsn         string
+		wantDialect dialect
+		wantDSN     string
+	}{
+		{
+			name:        "postgres URL",
+			dsn:         "postgres://tubely@localhost/tubely?sslmode=disable",
+			wantDialect: dialectPostgres,
+			wantDSN:     "postgres://tubely@localhost/tubely?sslmode=disable",
+		},
+		{
+			name:        "postgresql URL",
+			dsn:         "postgresql://localhost/tubely",
+			wantDialect: dialectPostgres,
+			wantDSN:     "postgresql://localhost/tubely",
+		},
+		{
+			name:        "SQLite path",
+			dsn:         "tubely.db",
+			wantDialect: dialectSQLite,
+			wantDSN:     "tubely.db?_busy_timeout=5000&_journal_mode=WAL",
+		},
+		{
+			name:        "sqlite URL",
+			dsn:         "sqlite://tubely.db",
+			wantDialect: dialectSQLite,
+			wantDSN:     "tubely.db?_busy_timeout=5000&_journal_mode=WAL",
+		},
+		{
+			name:        "SQLite with other parameters",
+			dsn:         "file:tubely.db?cache=shared",
+			wantDialect: dialectSQLite,
+			wantDSN:     "file:tubely.db?cache=shared&_busy_timeout=5000&_journal_mode=WAL",
+		},
+		{
+			name:        "SQLite with its own settings",
+			dsn:         "tubely.db?_timeout=100&_journal=DELETE",
+			wantDialect: dialectSQLite,
+			wantDSN:     "tubely.db?_timeout=100&_journal=DELETE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotDialect, gotDSN := parseDSN(tt.dsn)
+			if gotDialect != tt.wantDialect || gotDSN != tt.wantDSN {
+				t.Errorf("parseDSN(%q) = %s, %q, want %s, %q", tt.dsn, gotDialect, gotDSN, tt.wantDialect, tt.wantDSN)
+			}
+		})
+	}
+}
+
+func TestSQLiteSettings(t *testing.T) {
+	c := newTestClient(t, filepath.Join(t.TempDir(), "tubely.db"))
+
+	tests := []struct {
+		pragma string
+		want   string
+	}{
+		{pragma: "busy_timeout", want: "5000"},
+		{pragma: "journal_mode", want: "wal"},
+		{pragma: "foreign_keys", want: "0"},
+	}
+	for _, tt := range tests {
+		var got string
+		if err := c.queryRow("PRAGMA " + tt.pragma).Scan(&got); err != nil {
+			t.Fatalf("PRAGMA %s: %v", tt.pragma, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.pragma, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+)
+
+type Job struct {
+	ID          uuid.UUID       `json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LockedUntil *time.Time      `json:"locked_until"`
+	LastError   *string         `json:"last_error"`
+}
+
+type CreateJobParams struct {
+	Type        string
+	Payload     any
+	MaxAttempts int
+	RunAt       time.Time
+	// DedupeKey, if set, must be unique across all jobs ever queued
+	DedupeKey string
+}
+
+const jobColumns = `
+		id,
+		created_at,
+		updated_at,
+		type,
+		payload,
+		status,
+		attempts,
+		max_attempts,
+		run_at,
+		locked_until,
+		last_error`
+
+func scanJob(row rowScanner) (Job, error) {
+	var job Job
+	var payload string
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.Type,
+		&payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LockedUntil,
+		&job.LastError,
+	)
+	job.Payload = json.RawMessage(payload)
+	return job, err
+}
+
+func (c Client) CreateJob(params CreateJobParams) (Job, error) {
+	var id uuid.UUID
+	err := c.inTx(func(t tx) error {
+		var err error
+		id, err = createJob(t, params)
+		return err
+	})
+	if err != nil {
+		return Job{}, err
+	}
+	return c.GetJob(id)
+}
+
+// CreateVideoJob sets the video's status and queues a job for it in the same
+// transaction, so a video is never marked as uploaded without work queued.
+// Every call takes the next upload sequence number of the video, which is
+// passed to params to build the job. See ReplaceVideoFile.
+//
+// If a job was queued with dedupeKey before, nothing changes and that job is
+// returned, so retried requests don't queue the same work twice.
+func (c Client) CreateVideoJob(videoID uuid.UUID, status, dedupeKey string, params func(uploadSeq int64) CreateJobParams) (Job, error) {
+	var id uuid.UUID
+	err := c.inTx(func(t tx) error {
+		err := t.queryRow(`SELECT id FROM jobs WHERE dedupe_key = ?`, dedupeKey).Scan(&id)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		_, err = t.exec(`
+		UPDATE videos
+		SET
+			status = ?,
+			upload_seq = upload_seq + 1,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+		`, status, videoID)
+		if err != nil {
+			return err
+		}
+		var uploadSeq int64
+		err = t.queryRow(`SELECT upload_seq FROM videos WHERE id = ?`, videoID).Scan(&uploadSeq)
+		if err != nil {
+			return err
+		}
+		jobParams := params(uploadSeq)
+		jobParams.DedupeKey = dedupeKey
+		id, err = createJob(t, jobParams)
+		return err
+	})
+	if err != nil {
+		return Job{}, err
+	}
+	return c.GetJob(id)
+}
+
+// DeleteVideoWithJob deletes a video and the rows that belong to it, and
+// queues a job in the same transaction. The job cleans up the video's blobs,
+// so they are never left behind by a delete that went through.
+func (c Client) DeleteVideoWithJob(videoID uuid.UUID, params CreateJobParams) (Job, error) {
+	var id uuid.UUID
+	err := c.inTx(func(t tx) error {
+		// SQLite doesn't enforce foreign keys, so don't rely on cascades
+		for _, query := range []string{
+			`DELETE FROM share_links WHERE video_id = ?`,
+			`DELETE FROM video_uploads WHERE video_id = ?`,
+			`DELETE FROM video_versions WHERE video_id = ?`,
+			`DELETE FROM videos WHERE id = ?`,
+		} {
+			if _, err := t.exec(query, videoID); err != nil {
+				return err
+			}
+		}
+		var err error
+		id, err = createJob(t, params)
+		return err
+	})
+	if err != nil {
+		return Job{}, err
+	}
+	return c.GetJob(id)
+}
+
+func createJob(t tx, params CreateJobParams) (uuid.UUID, error) {
+	payload, err := json.Marshal(params.Payload)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if params.MaxAttempts <= 0 {
+		params.MaxAttempts = 1
+	}
+	if params.RunAt.IsZero() {
+		params.RunAt = time.Now()
+	}
+
+	id := uuid.New()
+	query := `
+	INSERT INTO jobs (
+		id,
+		created_at,
+		updated_at,
+		type,
+		payload,
+		status,
+		attempts,
+		max_attempts,
+		run_at,
+		dedupe_key
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, 0, ?, ?, ?)
+	`
+	// NULLs don't collide in the unique index, empty strings would
+	var dedupeKey *string
+	if params.DedupeKey != "" {
+		dedupeKey = &params.DedupeKey
+	}
+	_, err = t.exec(query, id, params.Type, string(payload), JobStatusQueued, params.MaxAttempts, params.RunAt.UTC(), dedupeKey)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+func (c Client) GetJob(id uuid.UUID) (Job, error) {
+	query := `
+	SELECT` + jobColumns + `
+	FROM jobs
+	WHERE id = ?
+	`
+	job, err := scanJob(c.queryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, nil
+		}
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// GetJobByDedupeKey returns the job queued with dedupeKey, or a zero Job.
+func (c Client) GetJobByDedupeKey(dedupeKey string) (Job, error) {
+	query := `
+	SELECT` + jobColumns + `
+	FROM jobs
+	WHERE dedupe_key = ?
+	`
+	job, err := scanJob(c.queryRow(query, dedupeKey))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, nil
+		}
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// GetUnfinishedJobs returns the queued and running jobs of a type.
+func (c Client) GetUnfinishedJobs(jobType string) ([]Job, error) {
+	query := `
+	SELECT` + jobColumns + `
+	FROM jobs
+	WHERE type = ? AND status IN (?, ?)
+	`
+	rows, err := c.query(query, jobType, JobStatusQueued, JobStatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// ClaimJob locks the next due job until now+lockFor and returns it. Jobs
+// whose lock ran out, because the worker holding them died, are claimed
+// again. It returns a zero Job when nothing is due.
+func (c Client) ClaimJob(now time.Time, lockFor time.Duration) (Job, error) {
+	skipLocked := ""
+	if c.dialect == dialectPostgres {
+		skipLocked = "FOR UPDATE SKIP LOCKED"
+	}
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		attempts = attempts + 1,
+		locked_until = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id
+		FROM jobs
+		WHERE (status = ? AND run_at <= ?)
+			OR (status = ? AND locked_until < ?)
+		ORDER BY run_at
+		LIMIT 1
+		` + skipLocked + `
+	)
+	RETURNING` + jobColumns
+
+	now = now.UTC()
+	job, err := scanJob(c.queryRow(
+		query,
+		JobStatusRunning,
+		now.Add(lockFor),
+		JobStatusQueued,
+		now,
+		JobStatusRunning,
+		now,
+	))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, nil
+		}
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// ExtendJobLock keeps a long running job from being claimed by another
+// worker.
+func (c Client) ExtendJobLock(id uuid.UUID, until time.Time) error {
+	query := `
+	UPDATE jobs
+	SET locked_until = ?
+	WHERE id = ? AND status = ?
+	`
+	_, err := c.exec(query, until.UTC(), id, JobStatusRunning)
+	return err
+}
+
+func (c Client) CompleteJob(id uuid.UUID) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		locked_until = NULL,
+		last_error = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.exec(query, JobStatusSucceeded, id)
+	return err
+}
+
+// RetryJob puts a failed job back in the queue to run again at runAt.
+func (c Client) RetryJob(id uuid.UUID, jobErr string, runAt time.Time) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		run_at = ?,
+		locked_until = NULL,
+		last_error = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.exec(query, JobStatusQueued, runAt.UTC(), jobErr, id)
+	return err
+}
+
+// FailJob marks a job as permanently failed.
+func (c Client) FailJob(id uuid.UUID, jobErr string) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		locked_until = NULL,
+		last_error = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.exec(query, JobStatusFailed, jobErr, id)
+	return err
+}
@@ -0,0 +1,170 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestClaimJob(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		c := newTestClient(t, dsn)
+		now := time.Now()
+
+		createJob := func(runAt time.Time) Job {
+			t.Helper()
+			job, err := c.CreateJob(CreateJobParams{
+				Type:        "test",
+				Payload:     map[string]string{"key": "value"},
+				MaxAttempts: 3,
+				RunAt:       runAt,
+			})
+			if err != nil {
+				t.Fatalf("CreateJob: %v", err)
+			}
+			return job
+		}
+		due := createJob(now)
+		later := createJob(now.Add(time.Hour))
+
+		// Each step claims at its time, after running its setup
+		steps := []struct {
+			name         string
+			setup        func() error
+			at           time.Time
+			wantID       uuid.UUID
+			wantAttempts int
+		}{
+			{
+				name:         "due job",
+				at:           now,
+				wantID:       due.ID,
+				wantAttempts: 1,
+			},
+			{
+				name:   "locked job",
+				at:     now.Add(30 * time.Second),
+				wantID: uuid.Nil,
+			},
+			{
+				name:         "lock ran out",
+				at:           now.Add(2 * time.Minute),
+				wantID:       due.ID,
+				wantAttempts: 2,
+			},
+			{
+				name: "retry backs off",
+				setup: func() error {
+					return c.RetryJob(due.ID, "boom", now.Add(30*time.Minute))
+				},
+				at:     now.Add(10 * time.Minute),
+				wantID: uuid.Nil,
+			},
+			{
+				name:         "retry is due",
+				at:           now.Add(30 * time.Minute),
+				wantID:       due.ID,
+				wantAttempts: 3,
+			},
+			{
+				name: "completed job",
+				setup: func() error {
+					return c.CompleteJob(due.ID)
+				},
+				at:     now.Add(50 * time.Minute),
+				wantID: uuid.Nil,
+			},
+			{
+				name:         "job scheduled later",
+				at:           now.Add(time.Hour),
+				wantID:       later.ID,
+				wantAttempts: 1,
+			},
+			{
+				name: "failed job",
+				setup: func() error {
+					return c.FailJob(later.ID, "boom")
+				},
+				at:     now.Add(24 * time.Hour),
+				wantID: uuid.Nil,
+			},
+		}
+		for _, step := range steps {
+			if step.setup != nil {
+				if err := step.setup(); err != nil {
+					t.Fatalf("%s: setup: %v", step.name, err)
+				}
+			}
+			job, err := c.ClaimJob(step.at, time.Minute)
+			if err != nil {
+				t.Fatalf("%s: ClaimJob: %v", step.name, err)
+			}
+			if job.ID != step.wantID {
+				t.Fatalf("%s: claimed job %v, want %v", step.name, job.ID, step.wantID)
+			}
+			if job.ID == uuid.Nil {
+				continue
+			}
+			if job.Status != JobStatusRunning {
+				t.Errorf("%s: status %q, want %q", step.name, job.Status, JobStatusRunning)
+			}
+			if job.Attempts != step.wantAttempts {
+				t.Errorf("%s: attempts %d, want %d", step.name, job.Attempts, step.wantAttempts)
+			}
+			// Postgres keeps microseconds
+			if job.LockedUntil == nil || job.LockedUntil.Sub(step.at.Add(time.Minute)).Abs() > time.Millisecond {
+				t.Errorf("%s: locked until %v, want %v", step.name, job.LockedUntil, step.at.Add(time.Minute))
+			}
+		}
+
+		completed, err := c.GetJob(due.ID)
+		if err != nil {
+			t.Fatalf("GetJob: %v", err)
+		}
+		if completed.Status != JobStatusSucceeded || completed.LastError != nil {
+			t.Errorf("completed job has status %q and error %v", completed.Status, completed.LastError)
+		}
+	})
+}
+
+func TestCreateVideoJobDedupe(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		c := newTestClient(t, dsn)
+		video := createTestVideo(t, c, createTestUser(t, c).ID)
+
+		var uploadSeqs []int64
+		params := func(uploadSeq int64) CreateJobParams {
+			uploadSeqs = append(uploadSeqs, uploadSeq)
+			return CreateJobParams{Type: "test", Payload: uploadSeq, MaxAttempts: 1, RunAt: time.Now()}
+		}
+
+		tests := []struct {
+			name      string
+			dedupeKey string
+			wantSeq   int64
+		}{
+			{name: "first upload", dedupeKey: "uploads/a.mp4", wantSeq: 1},
+			{name: "second upload", dedupeKey: "uploads/b.mp4", wantSeq: 2},
+			{name: "first upload again", dedupeKey: "uploads/a.mp4", wantSeq: 1},
+		}
+		jobs := map[string]uuid.UUID{}
+		for _, tt := range tests {
+			job, err := c.CreateVideoJob(video.ID, VideoStatusUploaded, tt.dedupeKey, params)
+			if err != nil {
+				t.Fatalf("%s: CreateVideoJob: %v", tt.name, err)
+			}
+			if id, ok := jobs[tt.dedupeKey]; ok && id != job.ID {
+				t.Errorf("%s: queued job %v, want %v again", tt.name, job.ID, id)
+			}
+			jobs[tt.dedupeKey] = job.ID
+			if string(job.Payload) != fmt.Sprint(tt.wantSeq) {
+				t.Errorf("%s: job for upload %s, want %d", tt.name, job.Payload, tt.wantSeq)
+			}
+		}
+		if len(uploadSeqs) != 2 {
+			t.Errorf("queued jobs for uploads %v, want 2 jobs", uploadSeqs)
+		}
+	})
+}
@@ -0,0 +1,963 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+type migration struct {
+	version  int
+	name     string
+	sqlite   migrationSQL
+	postgres migrationSQL
+}
+
+type migrationSQL struct {
+	up   string
+	down string
+}
+
+func (m migration) sql(d dialect) migrationSQL {
+	if d == dialectPostgres {
+		return m.postgres
+	}
+	return m.sqlite
+}
+
+func (s migrationSQL) checksum() string {
+	sum := sha256.Sum256([]byte(s.up + "\n-- down\n" + s.down))
+	return hex.EncodeToString(sum[:])
+}
+
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// migrations are applied in order and must never be edited once released,
+// add a new migration instead. The checksum of every applied migration is
+// validated before anything else runs. Each migration carries the SQL for
+// every dialect so versions line up across SQLite and Postgres.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create_initial_tables",
+		sqlite: migrationSQL{
+			up: `
+		CREATE TABLE IF NOT EXISTS users (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			password TEXT NOT NULL,
+			email TEXT UNIQUE NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS refresh_tokens (
+			token TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			revoked_at TIMESTAMP,
+			user_id TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+		CREATE TABLE IF NOT EXISTS videos (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			title TEXT NOT NULL,
+			description TEXT,
+			thumbnail_url TEXT,
+			video_url TEXT TEXT,
+			user_id INTEGER,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+		`,
+			down: `
+		DROP TABLE videos;
+		DROP TABLE refresh_tokens;
+		DROP TABLE users;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		CREATE TABLE users (
+			id UUID PRIMARY KEY,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			password TEXT NOT NULL,
+			email TEXT UNIQUE NOT NULL
+		);
+		CREATE TABLE refresh_tokens (
+			token TEXT PRIMARY KEY,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			revoked_at TIMESTAMPTZ,
+			user_id UUID NOT NULL REFERENCES users(id),
+			expires_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE TABLE videos (
+			id UUID PRIMARY KEY,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			title TEXT NOT NULL,
+			description TEXT,
+			thumbnail_url TEXT,
+			video_url TEXT,
+			user_id UUID NOT NULL REFERENCES users(id)
+		);
+		`,
+			down: `
+		DROP TABLE videos;
+		DROP TABLE refresh_tokens;
+		DROP TABLE users;
+		`,
+		},
+	},
+	{
+		version: 2,
+		name:    "fix_videos_column_types",
+		// SQLite can't change a column type in place, so rebuild the table.
+		// Postgres was created with the right types in the first place.
+		sqlite: migrationSQL{
+			up: `
+		CREATE TABLE videos_new (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			title TEXT NOT NULL,
+			description TEXT,
+			thumbnail_url TEXT,
+			video_url TEXT,
+			user_id TEXT NOT NULL,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+		INSERT INTO videos_new (id, created_at, updated_at, title, description, thumbnail_url, video_url, user_id)
+		SELECT id, created_at, updated_at, title, description, thumbnail_url, video_url, CAST(user_id AS TEXT)
+		FROM videos;
+		DROP TABLE videos;
+		ALTER TABLE videos_new RENAME TO videos;
+		CREATE INDEX idx_videos_user_id ON videos(user_id);
+		`,
+			down: `
+		CREATE TABLE videos_old (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			title TEXT NOT NULL,
+			description TEXT,
+			thumbnail_url TEXT,
+			video_url TEXT TEXT,
+			user_id INTEGER,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+		INSERT INTO videos_old (id, created_at, updated_at, title, description, thumbnail_url, video_url, user_id)
+		SELECT id, created_at, updated_at, title, description, thumbnail_url, video_url, user_id
+		FROM videos;
+		DROP TABLE videos;
+		ALTER TABLE videos_old RENAME TO videos;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		CREATE INDEX idx_videos_user_id ON videos(user_id);
+		`,
+			down: `
+		DROP INDEX idx_videos_user_id;
+		`,
+		},
+	},
+	{
+		version: 3,
+		name:    "create_video_uploads",
+		sqlite: migrationSQL{
+			up: `
+		CREATE TABLE video_uploads (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			video_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			upload_length INTEGER NOT NULL,
+			upload_offset INTEGER NOT NULL DEFAULT 0,
+			content_type TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+		CREATE INDEX idx_video_uploads_expires_at ON video_uploads(expires_at);
+		`,
+			down: `
+		DROP TABLE video_uploads;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		CREATE TABLE video_uploads (
+			id UUID PRIMARY KEY,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			video_id UUID NOT NULL REFERENCES videos(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id),
+			upload_length BIGINT NOT NULL,
+			upload_offset BIGINT NOT NULL DEFAULT 0,
+			content_type TEXT NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX idx_video_uploads_expires_at ON video_uploads(expires_at);
+		`,
+			down: `
+		DROP TABLE video_uploads;
+		`,
+		},
+	},
+	{
+		version: 4,
+		name:    "create_jobs_and_video_status",
+		sqlite: migrationSQL{
+			up: `
+		CREATE TABLE jobs (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			type TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			max_attempts INTEGER NOT NULL,
+			run_at TIMESTAMP NOT NULL,
+			locked_until TIMESTAMP,
+			last_error TEXT
+		);
+		CREATE INDEX idx_jobs_status_run_at ON jobs(status, run_at);
+		ALTER TABLE videos ADD COLUMN status TEXT NOT NULL DEFAULT 'created';
+		UPDATE videos SET status = 'ready' WHERE video_url IS NOT NULL;
+		`,
+			down: `
+		ALTER TABLE videos DROP COLUMN status;
+		DROP TABLE jobs;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		CREATE TABLE jobs (
+			id UUID PRIMARY KEY,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			type TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			max_attempts INTEGER NOT NULL,
+			run_at TIMESTAMPTZ NOT NULL,
+			locked_until TIMESTAMPTZ,
+			last_error TEXT
+		);
+		CREATE INDEX idx_jobs_status_run_at ON jobs(status, run_at);
+		ALTER TABLE videos ADD COLUMN status TEXT NOT NULL DEFAULT 'created';
+		UPDATE videos SET status = 'ready' WHERE video_url IS NOT NULL;
+		`,
+			down: `
+		ALTER TABLE videos DROP COLUMN status;
+		DROP TABLE jobs;
+		`,
+		},
+	},
+	{
+		version: 5,
+		name:    "add_video_hls_url",
+		sqlite: migrationSQL{
+			up: `
+		ALTER TABLE videos ADD COLUMN hls_url TEXT;
+		`,
+			down: `
+		ALTER TABLE videos DROP COLUMN hls_url;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		ALTER TABLE videos ADD COLUMN hls_url TEXT;
+		`,
+			down: `
+		ALTER TABLE videos DROP COLUMN hls_url;
+		`,
+		},
+	},
+	{
+		version: 6,
+		name:    "add_video_dash_url",
+		sqlite: migrationSQL{
+			up: `
+		ALTER TABLE videos ADD COLUMN dash_url TEXT;
+		`,
+			down: `
+		ALTER TABLE videos DROP COLUMN dash_url;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		ALTER TABLE videos ADD COLUMN dash_url TEXT;
+		`,
+			down: `
+		ALTER TABLE videos DROP COLUMN dash_url;
+		`,
+		},
+	},
+	{
+		version: 7,
+		name:    "add_video_metadata",
+		sqlite: migrationSQL{
+			up: `
+		ALTER TABLE videos ADD COLUMN duration_seconds REAL;
+		ALTER TABLE videos ADD COLUMN video_codec TEXT;
+		ALTER TABLE videos ADD COLUMN audio_codec TEXT;
+		ALTER TABLE videos ADD COLUMN bitrate INTEGER;
+		ALTER TABLE videos ADD COLUMN frame_rate REAL;
+		ALTER TABLE videos ADD COLUMN rotation INTEGER;
+		ALTER TABLE videos ADD COLUMN audio_channel_layout TEXT;
+		`,
+			down: `
+		ALTER TABLE videos DROP COLUMN audio_channel_layout;
+		ALTER TABLE videos DROP COLUMN rotation;
+		ALTER TABLE videos DROP COLUMN frame_rate;
+		ALTER TABLE videos DROP COLUMN bitrate;
+		ALTER TABLE videos DROP COLUMN audio_codec;
+		ALTER TABLE videos DROP COLUMN video_codec;
+		ALTER TABLE videos DROP COLUMN duration_seconds;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		ALTER TABLE videos ADD COLUMN duration_seconds DOUBLE PRECISION;
+		ALTER TABLE videos ADD COLUMN video_codec TEXT;
+		ALTER TABLE videos ADD COLUMN audio_codec TEXT;
+		ALTER TABLE videos ADD COLUMN bitrate BIGINT;
+		ALTER TABLE videos ADD COLUMN frame_rate DOUBLE PRECISION;
+		ALTER TABLE videos ADD COLUMN rotation INTEGER;
+		ALTER TABLE videos ADD COLUMN audio_channel_layout TEXT;
+		`,
+			down: `
+		ALTER TABLE videos DROP COLUMN audio_channel_layout;
+		ALTER TABLE videos DROP COLUMN rotation;
+		ALTER TABLE videos DROP COLUMN frame_rate;
+		ALTER TABLE videos DROP COLUMN bitrate;
+		ALTER TABLE videos DROP COLUMN audio_codec;
+		ALTER TABLE videos DROP COLUMN video_codec;
+		ALTER TABLE videos DROP COLUMN duration_seconds;
+		`,
+		},
+	},
+	{
+		version: 8,
+		name:    "add_video_thumbnails",
+		sqlite: migrationSQL{
+			up: `
+		ALTER TABLE videos ADD COLUMN thumbnails TEXT;
+		ALTER TABLE videos ADD COLUMN thumbnail_source TEXT;
+		`,
+			down: `
+		ALTER TABLE videos DROP COLUMN thumbnail_source;
+		ALTER TABLE videos DROP COLUMN thumbnails;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		ALTER TABLE videos ADD COLUMN thumbnails TEXT;
+		ALTER TABLE videos ADD COLUMN thumbnail_source TEXT;
+		`,
+			down: `
+		ALTER TABLE videos DROP COLUMN thumbnail_source;
+		ALTER TABLE videos DROP COLUMN thumbnails;
+		`,
+		},
+	},
+	{
+		version: 9,
+		name:    "add_video_visibility",
+		sqlite: migrationSQL{
+			up: `
+		ALTER TABLE videos ADD COLUMN visibility TEXT NOT NULL DEFAULT 'private';
+		UPDATE videos SET visibility = 'unlisted';
+		CREATE INDEX idx_videos_visibility_created_at ON videos(visibility, created_at);
+		`,
+			down: `
+		DROP INDEX idx_videos_visibility_created_at;
+		ALTER TABLE videos DROP COLUMN visibility;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		ALTER TABLE videos ADD COLUMN visibility TEXT NOT NULL DEFAULT 'private';
+		UPDATE videos SET visibility = 'unlisted';
+		CREATE INDEX idx_videos_visibility_created_at ON videos(visibility, created_at);
+		`,
+			down: `
+		DROP INDEX idx_videos_visibility_created_at;
+		ALTER TABLE videos DROP COLUMN visibility;
+		`,
+		},
+	},
+	{
+		version: 10,
+		name:    "create_share_links",
+		sqlite: migrationSQL{
+			up: `
+		CREATE TABLE share_links (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			video_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			token_hash TEXT UNIQUE NOT NULL,
+			password TEXT,
+			expires_at TIMESTAMP NOT NULL,
+			max_views INTEGER,
+			view_count INTEGER NOT NULL DEFAULT 0,
+			revoked_at TIMESTAMP,
+			FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+		CREATE INDEX idx_share_links_video_id ON share_links(video_id);
+		`,
+			down: `
+		DROP TABLE share_links;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		CREATE TABLE share_links (
+			id UUID PRIMARY KEY,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			video_id UUID NOT NULL REFERENCES videos(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id),
+			token_hash TEXT UNIQUE NOT NULL,
+			password TEXT,
+			expires_at TIMESTAMPTZ NOT NULL,
+			max_views INTEGER,
+			view_count INTEGER NOT NULL DEFAULT 0,
+			revoked_at TIMESTAMPTZ
+		);
+		CREATE INDEX idx_share_links_video_id ON share_links(video_id);
+		`,
+			down: `
+		DROP TABLE share_links;
+		`,
+		},
+	},
+	{
+		version: 11,
+		name:    "add_video_upload_seq",
+		sqlite: migrationSQL{
+			up: `
+		ALTER TABLE videos ADD COLUMN upload_seq INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE videos ADD COLUMN file_seq INTEGER NOT NULL DEFAULT 0;
+		`,
+			down: `
+		ALTER TABLE videos DROP COLUMN file_seq;
+		ALTER TABLE videos DROP COLUMN upload_seq;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		ALTER TABLE videos ADD COLUMN upload_seq BIGINT NOT NULL DEFAULT 0;
+		ALTER TABLE videos ADD COLUMN file_seq BIGINT NOT NULL DEFAULT 0;
+		`,
+			down: `
+		ALTER TABLE videos DROP COLUMN file_seq;
+		ALTER TABLE videos DROP COLUMN upload_seq;
+		`,
+		},
+	},
+	{
+		version: 12,
+		name:    "create_video_versions",
+		sqlite: migrationSQL{
+			up: `
+		CREATE TABLE video_versions (
+			video_id TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			user_id TEXT NOT NULL,
+			video_url TEXT NOT NULL,
+			hls_url TEXT,
+			dash_url TEXT,
+			duration_seconds REAL,
+			video_codec TEXT,
+			audio_codec TEXT,
+			bitrate INTEGER,
+			frame_rate REAL,
+			rotation INTEGER,
+			audio_channel_layout TEXT,
+			PRIMARY KEY (video_id, version),
+			FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+		INSERT INTO video_versions (
+			video_id, version, created_at, user_id, video_url, hls_url, dash_url,
+			duration_seconds, video_codec, audio_codec, bitrate, frame_rate, rotation, audio_channel_layout
+		)
+		SELECT
+			id, 1, updated_at, user_id, video_url, hls_url, dash_url,
+			duration_seconds, video_codec, audio_codec, bitrate, frame_rate, rotation, audio_channel_layout
+		FROM videos
+		WHERE video_url IS NOT NULL;
+		`,
+			down: `
+		DROP TABLE video_versions;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		CREATE TABLE video_versions (
+			video_id UUID NOT NULL REFERENCES videos(id) ON DELETE CASCADE,
+			version INTEGER NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			user_id UUID NOT NULL REFERENCES users(id),
+			video_url TEXT NOT NULL,
+			hls_url TEXT,
+			dash_url TEXT,
+			duration_seconds DOUBLE PRECISION,
+			video_codec TEXT,
+			audio_codec TEXT,
+			bitrate BIGINT,
+			frame_rate DOUBLE PRECISION,
+			rotation INTEGER,
+			audio_channel_layout TEXT,
+			PRIMARY KEY (video_id, version)
+		);
+		INSERT INTO video_versions (
+			video_id, version, created_at, user_id, video_url, hls_url, dash_url,
+			duration_seconds, video_codec, audio_codec, bitrate, frame_rate, rotation, audio_channel_layout
+		)
+		SELECT
+			id, 1, updated_at, user_id, video_url, hls_url, dash_url,
+			duration_seconds, video_codec, audio_codec, bitrate, frame_rate, rotation, audio_channel_layout
+		FROM videos
+		WHERE video_url IS NOT NULL;
+		`,
+			down: `
+		DROP TABLE video_versions;
+		`,
+		},
+	},
+	{
+		version: 13,
+		name:    "create_api_keys",
+		sqlite: migrationSQL{
+			up: `
+		CREATE TABLE api_keys (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL,
+			key_hash TEXT UNIQUE NOT NULL,
+			scopes TEXT NOT NULL,
+			last_used_at TIMESTAMP,
+			revoked_at TIMESTAMP,
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_api_keys_user_id ON api_keys(user_id);
+		`,
+			down: `
+		DROP TABLE api_keys;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		CREATE TABLE api_keys (
+			id UUID PRIMARY KEY,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL,
+			key_hash TEXT UNIQUE NOT NULL,
+			scopes TEXT NOT NULL,
+			last_used_at TIMESTAMPTZ,
+			revoked_at TIMESTAMPTZ
+		);
+		CREATE INDEX idx_api_keys_user_id ON api_keys(user_id);
+		`,
+			down: `
+		DROP TABLE api_keys;
+		`,
+		},
+	},
+	{
+		version: 14,
+		name:    "add_refresh_token_families",
+		// SQLite can't add a NOT NULL column without a default, so rebuild
+		// the table. Existing tokens each get a family of their own, formatted
+		// like the UUIDs new families get.
+		sqlite: migrationSQL{
+			up: `
+		CREATE TABLE refresh_tokens_new (
+			token TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			revoked_at TIMESTAMP,
+			user_id TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			family_id TEXT NOT NULL,
+			rotated_at TIMESTAMP,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+		INSERT INTO refresh_tokens_new (token, created_at, updated_at, revoked_at, user_id, expires_at, family_id)
+		SELECT token, created_at, updated_at, revoked_at, user_id, expires_at,
+			lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-' || hex(randomblob(2)) || '-' || hex(randomblob(2)) || '-' || hex(randomblob(6)))
+		FROM refresh_tokens;
+		DROP TABLE refresh_tokens;
+		ALTER TABLE refresh_tokens_new RENAME TO refresh_tokens;
+		CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+		`,
+			down: `
+		DROP INDEX idx_refresh_tokens_family_id;
+		ALTER TABLE refresh_tokens DROP COLUMN rotated_at;
+		ALTER TABLE refresh_tokens DROP COLUMN family_id;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		ALTER TABLE refresh_tokens ADD COLUMN family_id UUID;
+		ALTER TABLE refresh_tokens ADD COLUMN rotated_at TIMESTAMPTZ;
+		UPDATE refresh_tokens SET family_id = gen_random_uuid();
+		ALTER TABLE refresh_tokens ALTER COLUMN family_id SET NOT NULL;
+		CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+		`,
+			down: `
+		DROP INDEX idx_refresh_tokens_family_id;
+		ALTER TABLE refresh_tokens DROP COLUMN rotated_at;
+		ALTER TABLE refresh_tokens DROP COLUMN family_id;
+		`,
+		},
+	},
+	{
+		version: 15,
+		name:    "add_sessions",
+		sqlite: migrationSQL{
+			up: `
+		ALTER TABLE refresh_tokens ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+		ALTER TABLE refresh_tokens ADD COLUMN ip_address TEXT NOT NULL DEFAULT '';
+		ALTER TABLE refresh_tokens ADD COLUMN last_used_at TIMESTAMP;
+		ALTER TABLE refresh_tokens ADD COLUMN family_created_at TIMESTAMP;
+		UPDATE refresh_tokens SET family_created_at = created_at, last_used_at = updated_at;
+		ALTER TABLE users ADD COLUMN token_generation INTEGER NOT NULL DEFAULT 0;
+		CREATE INDEX idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+		`,
+			down: `
+		DROP INDEX idx_refresh_tokens_user_id;
+		ALTER TABLE users DROP COLUMN token_generation;
+		ALTER TABLE refresh_tokens DROP COLUMN family_created_at;
+		ALTER TABLE refresh_tokens DROP COLUMN last_used_at;
+		ALTER TABLE refresh_tokens DROP COLUMN ip_address;
+		ALTER TABLE refresh_tokens DROP COLUMN user_agent;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		ALTER TABLE refresh_tokens ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+		ALTER TABLE refresh_tokens ADD COLUMN ip_address TEXT NOT NULL DEFAULT '';
+		ALTER TABLE refresh_tokens ADD COLUMN last_used_at TIMESTAMPTZ;
+		ALTER TABLE refresh_tokens ADD COLUMN family_created_at TIMESTAMPTZ;
+		UPDATE refresh_tokens SET family_created_at = created_at, last_used_at = updated_at;
+		ALTER TABLE users ADD COLUMN token_generation BIGINT NOT NULL DEFAULT 0;
+		CREATE INDEX idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+		`,
+			down: `
+		DROP INDEX idx_refresh_tokens_user_id;
+		ALTER TABLE users DROP COLUMN token_generation;
+		ALTER TABLE refresh_tokens DROP COLUMN family_created_at;
+		ALTER TABLE refresh_tokens DROP COLUMN last_used_at;
+		ALTER TABLE refresh_tokens DROP COLUMN ip_address;
+		ALTER TABLE refresh_tokens DROP COLUMN user_agent;
+		`,
+		},
+	},
+	{
+		version: 16,
+		name:    "add_job_dedupe_keys",
+		sqlite: migrationSQL{
+			up: `
+		ALTER TABLE jobs ADD COLUMN dedupe_key TEXT;
+		CREATE UNIQUE INDEX idx_jobs_dedupe_key ON jobs(dedupe_key);
+		`,
+			down: `
+		DROP INDEX idx_jobs_dedupe_key;
+		ALTER TABLE jobs DROP COLUMN dedupe_key;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		ALTER TABLE jobs ADD COLUMN dedupe_key TEXT;
+		CREATE UNIQUE INDEX idx_jobs_dedupe_key ON jobs(dedupe_key);
+		`,
+			down: `
+		DROP INDEX idx_jobs_dedupe_key;
+		ALTER TABLE jobs DROP COLUMN dedupe_key;
+		`,
+		},
+	},
+	{
+		version: 17,
+		name:    "add_share_link_password_throttling",
+		sqlite: migrationSQL{
+			up: `
+		ALTER TABLE share_links ADD COLUMN failed_password_attempts INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE share_links ADD COLUMN password_locked_until TIMESTAMP;
+		`,
+			down: `
+		ALTER TABLE share_links DROP COLUMN password_locked_until;
+		ALTER TABLE share_links DROP COLUMN failed_password_attempts;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		ALTER TABLE share_links ADD COLUMN failed_password_attempts INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE share_links ADD COLUMN password_locked_until TIMESTAMPTZ;
+		`,
+			down: `
+		ALTER TABLE share_links DROP COLUMN password_locked_until;
+		ALTER TABLE share_links DROP COLUMN failed_password_attempts;
+		`,
+		},
+	},
+	{
+		version: 18,
+		name:    "add_video_upload_chunk_keys",
+		// Uploads in progress when this runs have no chunks recorded, their
+		// clients have to start over
+		sqlite: migrationSQL{
+			up: `
+		ALTER TABLE video_uploads ADD COLUMN chunk_keys TEXT NOT NULL DEFAULT '';
+		`,
+			down: `
+		ALTER TABLE video_uploads DROP COLUMN chunk_keys;
+		`,
+		},
+		postgres: migrationSQL{
+			up: `
+		ALTER TABLE video_uploads ADD COLUMN chunk_keys TEXT NOT NULL DEFAULT '';
+		`,
+			down: `
+		ALTER TABLE video_uploads DROP COLUMN chunk_keys;
+		`,
+		},
+	},
+}
+
+func (c Client) ensureMigrationsTable() error {
+	appliedAtType := "TIMESTAMP"
+	if c.dialect == dialectPostgres {
+		appliedAtType = "TIMESTAMPTZ"
+	}
+	query := `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at ` + appliedAtType + ` NOT NULL
+	);
+	`
+	_, err := c.exec(query)
+	return err
+}
+
+func (c Client) appliedMigrations() (map[int]string, error) {
+	if err := c.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := c.query(`SELECT version, checksum FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]string{}
+	for rows.Next() {
+		var version int
+		var checksum string
+		if err := rows.Scan(&version, &checksum); err != nil {
+			return nil, err
+		}
+		applied[version] = checksum
+	}
+	return applied, rows.Err()
+}
+
+// validateMigrations makes sure every applied migration is still known and
+// unchanged, so a database is never migrated on top of an edited history.
+func (c Client) validateMigrations() (map[int]string, error) {
+	applied, err := c.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[int]migration{}
+	for _, m := range migrations {
+		known[m.version] = m
+	}
+	for version, checksum := range applied {
+		m, ok := known[version]
+		if !ok {
+			return nil, fmt.Errorf("database has unknown migration %d applied", version)
+		}
+		if m.sql(c.dialect).checksum() != checksum {
+			return nil, fmt.Errorf("checksum mismatch for migration %d_%s", m.version, m.name)
+		}
+	}
+	return applied, nil
+}
+
+// migrationLockID is the Postgres advisory lock migrations run under.
+const migrationLockID = 7316023945
+
+// withMigrationLock runs fn while holding the migration lock, so replicas
+// starting together against one Postgres database migrate one at a time.
+// The others wait, then find the migrations applied. SQLite databases are
+// local to one process and aren't locked.
+func (c Client) withMigrationLock(fn func() error) error {
+	if c.dialect != dialectPostgres {
+		return fn()
+	}
+
+	// Advisory locks belong to a session, so lock and unlock on one
+	// connection
+	ctx := context.Background()
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("couldn't take migration lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	return fn()
+}
+
+// MigrateUp applies all pending migrations and returns the versions applied.
+func (c Client) MigrateUp() ([]int, error) {
+	var versions []int
+	err := c.withMigrationLock(func() error {
+		var err error
+		versions, err = c.migrateUp()
+		return err
+	})
+	return versions, err
+}
+
+func (c Client) migrateUp() ([]int, error) {
+	applied, err := c.validateMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []int{}
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		steps := m.sql(c.dialect)
+		err := c.inTx(func(t tx) error {
+			if _, err := t.exec(steps.up); err != nil {
+				return err
+			}
+			_, err := t.exec(
+				`INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)`,
+				m.version, m.name, steps.checksum(), time.Now().UTC(),
+			)
+			return err
+		})
+		if err != nil {
+			return versions, fmt.Errorf("migration %d_%s failed: %w", m.version, m.name, err)
+		}
+		versions = append(versions, m.version)
+	}
+	return versions, nil
+}
+
+// MigrateDown reverts the latest `steps` applied migrations and returns the
+// versions reverted.
+func (c Client) MigrateDown(steps int) ([]int, error) {
+	var versions []int
+	err := c.withMigrationLock(func() error {
+		var err error
+		versions, err = c.migrateDown(steps)
+		return err
+	})
+	return versions, err
+}
+
+func (c Client) migrateDown(steps int) ([]int, error) {
+	applied, err := c.validateMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []int{}
+	for i := len(migrations) - 1; i >= 0 && len(versions) < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		err := c.inTx(func(t tx) error {
+			if _, err := t.exec(m.sql(c.dialect).down); err != nil {
+				return err
+			}
+			_, err := t.exec(`DELETE FROM schema_migrations WHERE version = ?`, m.version)
+			return err
+		})
+		if err != nil {
+			return versions, fmt.Errorf("reverting migration %d_%s failed: %w", m.version, m.name, err)
+		}
+		versions = append(versions, m.version)
+	}
+	return versions, nil
+}
+
+func (c Client) MigrationStatus() ([]MigrationStatus, error) {
+	if _, err := c.validateMigrations(); err != nil {
+		return nil, err
+	}
+
+	rows, err := c.query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	appliedAt := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		appliedAt[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	for _, m := range migrations {
+		status := MigrationStatus{
+			Version: m.version,
+			Name:    m.name,
+		}
+		if at, ok := appliedAt[m.version]; ok {
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func allVersions() []int {
+	versions := []int{}
+	for _, m := range migrations {
+		versions = append(versions, m.version)
+	}
+	return versions
+}
+
+func TestMigrationsOrdered(t *testing.T) {
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version <= migrations[i-1].version {
+			t.Errorf("migration %d_%s comes after %d_%s",
+				migrations[i].version, migrations[i].name,
+				migrations[i-1].version, migrations[i-1].name)
+		}
+	}
+}
+
+func TestMigrateUp(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		c := openTestClient(t, dsn)
+
+		applied, err := c.MigrateUp()
+		if err != nil {
+			t.Fatalf("MigrateUp: %v", err)
+		}
+		if !slices.Equal(applied, allVersions()) {
+			t.Errorf("MigrateUp applied %v, want %v", applied, allVersions())
+		}
+
+		applied, err = c.MigrateUp()
+		if err != nil {
+			t.Fatalf("MigrateUp again: %v", err)
+		}
+		if len(applied) != 0 {
+			t.Errorf("MigrateUp again applied %v, want nothing", applied)
+		}
+	})
+}
+
+func TestMigrateDown(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		c := newTestClient(t, dsn)
+
+		reverted, err := c.MigrateDown(len(migrations))
+		if err != nil {
+			t.Fatalf("MigrateDown: %v", err)
+		}
+		want := allVersions()
+		slices.Reverse(want)
+		if !slices.Equal(reverted, want) {
+			t.Errorf("MigrateDown reverted %v, want %v", reverted, want)
+		}
+
+		applied, err := c.MigrateUp()
+		if err != nil {
+			t.Fatalf("MigrateUp after MigrateDown: %v", err)
+		}
+		if !slices.Equal(applied, allVersions()) {
+			t.Errorf("MigrateUp after MigrateDown applied %v, want %v", applied, allVersions())
+		}
+	})
+}
+
+func TestMigrateUpRejectsEditedHistory(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantErr string
+	}{
+		{
+			name:    "checksum mismatch",
+			query:   `UPDATE schema_migrations SET checksum = 'edited' WHERE version = 1`,
+			wantErr: "checksum mismatch for migration 1_",
+		},
+		{
+			name:    "unknown migration",
+			query:   `INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (100000, 'unknown', 'x', CURRENT_TIMESTAMP)`,
+			wantErr: "unknown migration 100000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachDialect(t, func(t *testing.T, dsn string) {
+				c := newTestClient(t, dsn)
+				if _, err := c.exec(tt.query); err != nil {
+					t.Fatalf("editing history: %v", err)
+				}
+
+				_, err := c.MigrateUp()
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("MigrateUp = %v, want an error containing %q", err, tt.wantErr)
+				}
+			})
+		})
+	}
+}
+
+func TestMigrateUpConcurrent(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		clients := []Client{openTestClient(t, dsn), openTestClient(t, dsn), openTestClient(t, dsn)}
+		if clients[0].dialect != dialectPostgres {
+			t.Skip("SQLite databases aren't shared between processes")
+		}
+
+		var wg sync.WaitGroup
+		results := make([][]int, len(clients))
+		for i, c := range clients {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				applied, err := c.MigrateUp()
+				if err != nil {
+					t.Errorf("MigrateUp: %v", err)
+				}
+				results[i] = applied
+			}()
+		}
+		wg.Wait()
+
+		applied := slices.Concat(results...)
+		slices.Sort(applied)
+		if !slices.Equal(applied, allVersions()) {
+			t.Errorf("migrations applied %v, want each of %v once", applied, allVersions())
+		}
+	})
+}
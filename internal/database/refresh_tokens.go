@@ -2,66 +2,214 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// ErrRefreshTokenReused is returned when a refresh token that was already
+// rotated is presented again. Only one of the holders can be the user, so
+// the whole family has been revoked.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// RefreshToken is a token for getting new access JWTs. Every refresh
+// rotates it: the token is marked rotated and a new one is issued in the
+// same family. A family is one login, the session the user sees.
 type RefreshToken struct {
 	CreateRefreshTokenParams
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	RevokedAt *time.Time `json:"revoked_at"`
+	RotatedAt *time.Time `json:"rotated_at"`
+	// LastUsedAt is when the token was issued, which is when its
+	// predecessor was last used
+	LastUsedAt time.Time `json:"last_used_at"`
+	// FamilyCreatedAt is when the user logged in
+	FamilyCreatedAt time.Time `json:"family_created_at"`
 }
 
 type CreateRefreshTokenParams struct {
 	Token     string    `json:"token"`
 	UserID    uuid.UUID `json:"user_id"`
+	FamilyID  uuid.UUID `json:"family_id"`
 	ExpiresAt time.Time `json:"expires_at"`
+	UserAgent string    `json:"user_agent"`
+	IPAddress string    `json:"ip_address"`
 }
 
+// CreateRefreshToken saves the first token of a new family.
 func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToken, error) {
-	query := `
+	now := time.Now().UTC()
+	_, err := c.exec(createRefreshTokenQuery,
+		params.Token,
+		params.UserID.String(),
+		params.FamilyID.String(),
+		params.ExpiresAt.UTC(),
+		params.UserAgent,
+		params.IPAddress,
+		now,
+		now,
+	)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	return c.GetRefreshToken(params.Token)
+}
+
+const createRefreshTokenQuery = `
 		INSERT INTO refresh_tokens (
 			token,
 			created_at,
 			updated_at,
 			user_id,
-			expires_at
-		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+			family_id,
+			expires_at,
+			user_agent,
+			ip_address,
+			last_used_at,
+			family_created_at
+		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt)
+
+// RotateRefreshToken exchanges a refresh token for next, which takes over
+// its user and family. It returns a zero RefreshToken when the token is
+// unknown, revoked or expired at now, and ErrRefreshTokenReused when it was
+// rotated before.
+func (c Client) RotateRefreshToken(token string, next CreateRefreshTokenParams, now time.Time) (RefreshToken, error) {
+	forUpdate := ""
+	if c.dialect == dialectPostgres {
+		forUpdate = "FOR UPDATE"
+	}
+
+	rotated, reused := false, false
+	err := c.inTx(func(t tx) error {
+		rt, err := scanRefreshToken(t.queryRow(`
+		SELECT`+refreshTokenColumns+`
+		FROM refresh_tokens
+		WHERE token = ? `+forUpdate, token))
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rt.RotatedAt != nil {
+			reused = true
+			return revokeRefreshTokenFamily(t, rt.FamilyID)
+		}
+		if rt.RevokedAt != nil || !now.Before(rt.ExpiresAt) {
+			return nil
+		}
+
+		// Only mark it rotated if no one else did in the meantime
+		result, err := t.exec(`
+		UPDATE refresh_tokens
+		SET
+			rotated_at = ?,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE token = ? AND rotated_at IS NULL AND revoked_at IS NULL
+		`, now.UTC(), token)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			reused = true
+			return revokeRefreshTokenFamily(t, rt.FamilyID)
+		}
+
+		_, err = t.exec(createRefreshTokenQuery,
+			next.Token,
+			rt.UserID.String(),
+			rt.FamilyID.String(),
+			next.ExpiresAt.UTC(),
+			next.UserAgent,
+			next.IPAddress,
+			now.UTC(),
+			rt.FamilyCreatedAt.UTC(),
+		)
+		if err != nil {
+			return err
+		}
+		rotated = true
+		return nil
+	})
 	if err != nil {
 		return RefreshToken{}, err
 	}
-
-	return c.GetRefreshToken(params.Token)
+	if reused {
+		return RefreshToken{}, ErrRefreshTokenReused
+	}
+	if !rotated {
+		return RefreshToken{}, nil
+	}
+	return c.GetRefreshToken(next.Token)
 }
 
+// RevokeRefreshToken revokes the token and every other token of its family,
+// ending the login it belongs to.
 func (c Client) RevokeRefreshToken(token string) error {
-	query := `
+	return c.inTx(func(t tx) error {
+		var familyID uuid.UUID
+		err := t.queryRow(`SELECT family_id FROM refresh_tokens WHERE token = ?`, token).Scan(&familyID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return revokeRefreshTokenFamily(t, familyID)
+	})
+}
+
+func revokeRefreshTokenFamily(t tx, familyID uuid.UUID) error {
+	_, err := t.exec(`
 		UPDATE refresh_tokens
-		SET revoked_at = CURRENT_TIMESTAMP
-		WHERE token = ?
-	`
-	_, err := c.db.Exec(query, token)
+		SET
+			revoked_at = CURRENT_TIMESTAMP,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE family_id = ? AND revoked_at IS NULL
+	`, familyID.String())
 	return err
 }
 
-func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
-	query := `
-		SELECT token, created_at, updated_at, user_id, expires_at, revoked_at
-		FROM refresh_tokens
-		WHERE token = ?
-	`
+const refreshTokenColumns = `
+		token,
+		created_at,
+		updated_at,
+		user_id,
+		family_id,
+		expires_at,
+		revoked_at,
+		rotated_at,
+		user_agent,
+		ip_address,
+		last_used_at,
+		family_created_at`
+
+func scanRefreshToken(row rowScanner) (RefreshToken, error) {
 	var rt RefreshToken
-	var userID string
-	err := c.db.QueryRow(query, token).
-		Scan(&rt.Token, &rt.CreatedAt, &rt.UpdatedAt, &userID, &rt.ExpiresAt, &rt.RevokedAt)
+	var userID, familyID string
+	err := row.Scan(
+		&rt.Token,
+		&rt.CreatedAt,
+		&rt.UpdatedAt,
+		&userID,
+		&familyID,
+		&rt.ExpiresAt,
+		&rt.RevokedAt,
+		&rt.RotatedAt,
+		&rt.UserAgent,
+		&rt.IPAddress,
+		&rt.LastUsedAt,
+		&rt.FamilyCreatedAt,
+	)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return RefreshToken{}, nil
-		}
 		return RefreshToken{}, err
 	}
 
@@ -69,7 +217,26 @@ func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
 	if err != nil {
 		return RefreshToken{}, err
 	}
+	rt.FamilyID, err = uuid.Parse(familyID)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return rt, nil
+}
 
+func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
+	query := `
+		SELECT` + refreshTokenColumns + `
+		FROM refresh_tokens
+		WHERE token = ?
+	`
+	rt, err := scanRefreshToken(c.queryRow(query, token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return RefreshToken{}, nil
+		}
+		return RefreshToken{}, err
+	}
 	return rt, nil
 }
 
@@ -78,6 +245,6 @@ func (c Client) DeleteRefreshToken(token string) error {
 		DELETE FROM refresh_tokens
 		WHERE token = ?
 	`
-	_, err := c.db.Exec(query, token)
+	_, err := c.exec(query, token)
 	return err
 }
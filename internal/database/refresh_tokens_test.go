@@ -0,0 +1,153 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRotateRefreshToken(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		c := newTestClient(t, dsn)
+		user := createTestUser(t, c)
+		now := time.Now()
+
+		createToken := func(token string, expiresAt time.Time) RefreshToken {
+			t.Helper()
+			rt, err := c.CreateRefreshToken(CreateRefreshTokenParams{
+				Token:     token,
+				UserID:    user.ID,
+				FamilyID:  uuid.New(),
+				ExpiresAt: expiresAt,
+				UserAgent: "curl",
+			})
+			if err != nil {
+				t.Fatalf("CreateRefreshToken: %v", err)
+			}
+			return rt
+		}
+		login := createToken("login", now.Add(time.Hour))
+		createToken("expired", now.Add(-time.Minute))
+
+		// Each step rotates token into next
+		steps := []struct {
+			name        string
+			token       string
+			next        string
+			wantErr     error
+			wantRotated bool
+			// wantRevoked are tokens of the family revoked afterwards
+			wantRevoked []string
+		}{
+			{name: "first refresh", token: "login", next: "second", wantRotated: true},
+			{name: "second refresh", token: "second", next: "third", wantRotated: true},
+			{
+				name:        "reused token",
+				token:       "login",
+				next:        "stolen",
+				wantErr:     ErrRefreshTokenReused,
+				wantRevoked: []string{"login", "second", "third"},
+			},
+			{name: "revoked token", token: "third", next: "fourth"},
+			{name: "expired token", token: "expired", next: "renewed"},
+			{name: "unknown token", token: "unknown", next: "guessed"},
+		}
+		for _, step := range steps {
+			rt, err := c.RotateRefreshToken(step.token, CreateRefreshTokenParams{
+				Token:     step.next,
+				ExpiresAt: now.Add(time.Hour),
+				UserAgent: "curl",
+			}, now)
+			if !errors.Is(err, step.wantErr) {
+				t.Fatalf("%s: RotateRefreshToken = %v, want %v", step.name, err, step.wantErr)
+			}
+			if rotated := rt.Token != ""; rotated != step.wantRotated {
+				t.Fatalf("%s: rotated = %v, want %v", step.name, rotated, step.wantRotated)
+			}
+
+			if step.wantRotated {
+				if rt.Token != step.next || rt.UserID != user.ID || rt.FamilyID != login.FamilyID {
+					t.Errorf("%s: rotated into %+v, want %q in the login's family", step.name, rt.CreateRefreshTokenParams, step.next)
+				}
+				old, err := c.GetRefreshToken(step.token)
+				if err != nil {
+					t.Fatalf("%s: GetRefreshToken: %v", step.name, err)
+				}
+				if old.RotatedAt == nil {
+					t.Errorf("%s: %q isn't marked rotated", step.name, step.token)
+				}
+			} else {
+				// A token that wasn't rotated into must not exist
+				next, err := c.GetRefreshToken(step.next)
+				if err != nil {
+					t.Fatalf("%s: GetRefreshToken: %v", step.name, err)
+				}
+				if next.Token != "" {
+					t.Errorf("%s: %q was issued", step.name, step.next)
+				}
+			}
+
+			for _, token := range step.wantRevoked {
+				rt, err := c.GetRefreshToken(token)
+				if err != nil {
+					t.Fatalf("%s: GetRefreshToken: %v", step.name, err)
+				}
+				if rt.RevokedAt == nil {
+					t.Errorf("%s: %q isn't revoked", step.name, token)
+				}
+			}
+		}
+	})
+}
+
+func TestRevokeRefreshToken(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		c := newTestClient(t, dsn)
+		user := createTestUser(t, c)
+		now := time.Now()
+
+		for _, token := range []string{"laptop", "phone"} {
+			_, err := c.CreateRefreshToken(CreateRefreshTokenParams{
+				Token:     token,
+				UserID:    user.ID,
+				FamilyID:  uuid.New(),
+				ExpiresAt: now.Add(time.Hour),
+			})
+			if err != nil {
+				t.Fatalf("CreateRefreshToken: %v", err)
+			}
+		}
+		_, err := c.RotateRefreshToken("laptop", CreateRefreshTokenParams{
+			Token:     "laptop-2",
+			ExpiresAt: now.Add(time.Hour),
+		}, now)
+		if err != nil {
+			t.Fatalf("RotateRefreshToken: %v", err)
+		}
+
+		// Revoking an old token of the family logs the whole family out
+		if err := c.RevokeRefreshToken("laptop"); err != nil {
+			t.Fatalf("RevokeRefreshToken: %v", err)
+		}
+
+		tests := []struct {
+			token       string
+			wantRevoked bool
+		}{
+			{token: "laptop", wantRevoked: true},
+			{token: "laptop-2", wantRevoked: true},
+			{token: "phone", wantRevoked: false},
+		}
+		for _, tt := range tests {
+			rt, err := c.GetRefreshToken(tt.token)
+			if err != nil {
+				t.Fatalf("GetRefreshToken: %v", err)
+			}
+			if revoked := rt.RevokedAt != nil; revoked != tt.wantRevoked {
+				t.Errorf("%q revoked = %v, want %v", tt.token, revoked, tt.wantRevoked)
+			}
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session is a login, seen through the newest refresh token of its family.
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+}
+
+// GetSessions returns the user's sessions that can still be refreshed at
+// now, most recently used first.
+func (c Client) GetSessions(userID uuid.UUID, now time.Time) ([]Session, error) {
+	query := `
+		SELECT
+			family_id,
+			family_created_at,
+			last_used_at,
+			expires_at,
+			user_agent,
+			ip_address
+		FROM refresh_tokens
+		WHERE user_id = ? AND rotated_at IS NULL AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY last_used_at DESC
+	`
+	rows, err := c.query(query, userID.String(), now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		var id string
+		err := rows.Scan(
+			&id,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.ExpiresAt,
+			&session.UserAgent,
+			&session.IPAddress,
+		)
+		if err != nil {
+			return nil, err
+		}
+		session.ID, err = uuid.Parse(id)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// SessionActive reports whether the session hasn't been revoked. Sessions
+// that ran out without being revoked count as active, their access tokens
+// expire on their own.
+func (c Client) SessionActive(sessionID uuid.UUID) (bool, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM refresh_tokens
+		WHERE family_id = ? AND revoked_at IS NULL
+	`
+	var n int
+	err := c.queryRow(query, sessionID.String()).Scan(&n)
+	return n > 0, err
+}
+
+// RevokeSession revokes one of the user's sessions. It returns false if the
+// user has no such session that isn't revoked already.
+func (c Client) RevokeSession(userID, sessionID uuid.UUID) (bool, error) {
+	result, err := c.exec(`
+		UPDATE refresh_tokens
+		SET
+			revoked_at = CURRENT_TIMESTAMP,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE family_id = ? AND user_id = ? AND revoked_at IS NULL
+	`, sessionID.String(), userID.String())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// RevokeUserSessions logs the user out everywhere: every refresh token is
+// revoked and the user moves to a new token generation, so access tokens
+// issued so far stop being accepted too.
+func (c Client) RevokeUserSessions(userID uuid.UUID) error {
+	return c.inTx(func(t tx) error {
+		_, err := t.exec(`
+		UPDATE refresh_tokens
+		SET
+			revoked_at = CURRENT_TIMESTAMP,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND revoked_at IS NULL
+		`, userID.String())
+		if err != nil {
+			return err
+		}
+		_, err = t.exec(`
+		UPDATE users
+		SET
+			token_generation = token_generation + 1,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+		`, userID.String())
+		return err
+	})
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSessions(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		c := newTestClient(t, dsn)
+		user := createTestUser(t, c)
+		other := createTestUser(t, c)
+		now := time.Now()
+
+		login := func(userID uuid.UUID, token, userAgent string) uuid.UUID {
+			t.Helper()
+			rt, err := c.CreateRefreshToken(CreateRefreshTokenParams{
+				Token:     token,
+				UserID:    userID,
+				FamilyID:  uuid.New(),
+				ExpiresAt: now.Add(time.Hour),
+				UserAgent: userAgent,
+			})
+			if err != nil {
+				t.Fatalf("CreateRefreshToken: %v", err)
+			}
+			return rt.FamilyID
+		}
+		laptop := login(user.ID, "laptop", "firefox")
+		phone := login(user.ID, "phone", "safari")
+		login(other.ID, "other", "chrome")
+
+		// Refreshing on the phone makes it the most recently used session,
+		// and must not show up as a session of its own
+		_, err := c.RotateRefreshToken("phone", CreateRefreshTokenParams{
+			Token:     "phone-2",
+			ExpiresAt: now.Add(2 * time.Hour),
+			UserAgent: "safari",
+		}, now.Add(time.Minute))
+		if err != nil {
+			t.Fatalf("RotateRefreshToken: %v", err)
+		}
+
+		sessionIDs := func() []uuid.UUID {
+			t.Helper()
+			sessions, err := c.GetSessions(user.ID, now)
+			if err != nil {
+				t.Fatalf("GetSessions: %v", err)
+			}
+			ids := []uuid.UUID{}
+			for _, session := range sessions {
+				ids = append(ids, session.ID)
+			}
+			return ids
+		}
+		if got := sessionIDs(); len(got) != 2 || got[0] != phone || got[1] != laptop {
+			t.Errorf("sessions %v, want phone %v then laptop %v", got, phone, laptop)
+		}
+
+		tests := []struct {
+			name      string
+			userID    uuid.UUID
+			sessionID uuid.UUID
+			wantFound bool
+		}{
+			{name: "another user's session", userID: other.ID, sessionID: laptop, wantFound: false},
+			{name: "own session", userID: user.ID, sessionID: laptop, wantFound: true},
+			{name: "revoked session", userID: user.ID, sessionID: laptop, wantFound: false},
+			{name: "unknown session", userID: user.ID, sessionID: uuid.New(), wantFound: false},
+		}
+		for _, tt := range tests {
+			found, err := c.RevokeSession(tt.userID, tt.sessionID)
+			if err != nil {
+				t.Fatalf("%s: RevokeSession: %v", tt.name, err)
+			}
+			if found != tt.wantFound {
+				t.Errorf("%s: found = %v, want %v", tt.name, found, tt.wantFound)
+			}
+		}
+
+		for _, tt := range []struct {
+			sessionID  uuid.UUID
+			wantActive bool
+		}{
+			{sessionID: laptop, wantActive: false},
+			{sessionID: phone, wantActive: true},
+		} {
+			active, err := c.SessionActive(tt.sessionID)
+			if err != nil {
+				t.Fatalf("SessionActive: %v", err)
+			}
+			if active != tt.wantActive {
+				t.Errorf("session %v active = %v, want %v", tt.sessionID, active, tt.wantActive)
+			}
+		}
+		if got := sessionIDs(); len(got) != 1 || got[0] != phone {
+			t.Errorf("sessions after revoking the laptop %v, want phone %v", got, phone)
+		}
+
+		if err := c.RevokeUserSessions(user.ID); err != nil {
+			t.Fatalf("RevokeUserSessions: %v", err)
+		}
+		if got := sessionIDs(); len(got) != 0 {
+			t.Errorf("sessions after revoking all %v, want none", got)
+		}
+		revoked, err := c.GetUser(user.ID)
+		if err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+		if revoked.TokenGeneration != user.TokenGeneration+1 {
+			t.Errorf("token generation %d, want %d", revoked.TokenGeneration, user.TokenGeneration+1)
+		}
+		otherSessions, err := c.GetSessions(other.ID, now)
+		if err != nil {
+			t.Fatalf("GetSessions: %v", err)
+		}
+		if len(otherSessions) != 1 {
+			t.Errorf("other user has %d sessions, want 1", len(otherSessions))
+		}
+	})
+}
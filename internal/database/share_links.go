@@ -0,0 +1,230 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ShareLink grants access to a single video to whoever holds its token. Only
+// the hash of the token is stored.
+type ShareLink struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ViewCount int        `json:"view_count"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	// Wrong passwords since the last right one. Past a few, guessing is
+	// locked until PasswordLockedUntil.
+	FailedPasswordAttempts int        `json:"failed_password_attempts"`
+	PasswordLockedUntil    *time.Time `json:"password_locked_until"`
+	CreateShareLinkParams
+}
+
+type CreateShareLinkParams struct {
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	TokenHash string    `json:"-"`
+	Password  *string   `json:"-"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxViews  *int      `json:"max_views"`
+}
+
+const shareLinkColumns = `
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		token_hash,
+		password,
+		expires_at,
+		max_views,
+		view_count,
+		revoked_at,
+		failed_password_attempts,
+		password_locked_until`
+
+func scanShareLink(row rowScanner) (ShareLink, error) {
+	var link ShareLink
+	err := row.Scan(
+		&link.ID,
+		&link.CreatedAt,
+		&link.UpdatedAt,
+		&link.VideoID,
+		&link.UserID,
+		&link.TokenHash,
+		&link.Password,
+		&link.ExpiresAt,
+		&link.MaxViews,
+		&link.ViewCount,
+		&link.RevokedAt,
+		&link.FailedPasswordAttempts,
+		&link.PasswordLockedUntil,
+	)
+	return link, err
+}
+
+func (c Client) CreateShareLink(params CreateShareLinkParams) (ShareLink, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO share_links (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		token_hash,
+		password,
+		expires_at,
+		max_views
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.exec(
+		query,
+		id,
+		params.VideoID,
+		params.UserID,
+		params.TokenHash,
+		params.Password,
+		params.ExpiresAt.UTC(),
+		params.MaxViews,
+	)
+	if err != nil {
+		return ShareLink{}, err
+	}
+
+	return c.GetShareLink(id)
+}
+
+func (c Client) GetShareLink(id uuid.UUID) (ShareLink, error) {
+	query := `
+	SELECT` + shareLinkColumns + `
+	FROM share_links
+	WHERE id = ?
+	`
+	return c.getShareLink(query, id)
+}
+
+func (c Client) GetShareLinkByTokenHash(tokenHash string) (ShareLink, error) {
+	query := `
+	SELECT` + shareLinkColumns + `
+	FROM share_links
+	WHERE token_hash = ?
+	`
+	return c.getShareLink(query, tokenHash)
+}
+
+func (c Client) getShareLink(query string, arg any) (ShareLink, error) {
+	link, err := scanShareLink(c.queryRow(query, arg))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ShareLink{}, nil
+		}
+		return ShareLink{}, err
+	}
+	return link, nil
+}
+
+func (c Client) GetShareLinks(videoID uuid.UUID) ([]ShareLink, error) {
+	query := `
+	SELECT` + shareLinkColumns + `
+	FROM share_links
+	WHERE video_id = ?
+	ORDER BY created_at DESC
+	`
+
+	rows, err := c.query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// RecordShareLinkView counts a view of a share link. It reports false when
+// the link is revoked, expired or out of views, so concurrent requests can't
+// go over the limit.
+func (c Client) RecordShareLinkView(id uuid.UUID, now time.Time) (bool, error) {
+	query := `
+	UPDATE share_links
+	SET
+		view_count = view_count + 1,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+		AND revoked_at IS NULL
+		AND expires_at > ?
+		AND (max_views IS NULL OR view_count < max_views)
+	`
+	result, err := c.exec(query, id, now.UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ClaimShareLinkPasswordAttempt counts a password attempt on the link as it
+// was loaded, before the password is checked, and refuses further attempts
+// until lockedUntil if it's set. It counts nothing and returns false if the
+// link is locked at now or another attempt was counted since it was loaded,
+// so concurrent guesses can't each get an attempt.
+func (c Client) ClaimShareLinkPasswordAttempt(link ShareLink, lockedUntil *time.Time, now time.Time) (bool, error) {
+	if lockedUntil != nil {
+		until := lockedUntil.UTC()
+		lockedUntil = &until
+	}
+	query := `
+	UPDATE share_links
+	SET
+		failed_password_attempts = failed_password_attempts + 1,
+		password_locked_until = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+		AND failed_password_attempts = ?
+		AND (password_locked_until IS NULL OR password_locked_until <= ?)
+	`
+	result, err := c.exec(query, lockedUntil, link.ID, link.FailedPasswordAttempts, now.UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ResetShareLinkPasswordFailures clears the count after a right password.
+func (c Client) ResetShareLinkPasswordFailures(id uuid.UUID) error {
+	query := `
+	UPDATE share_links
+	SET
+		failed_password_attempts = 0,
+		password_locked_until = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.exec(query, id)
+	return err
+}
+
+func (c Client) RevokeShareLink(id uuid.UUID) error {
+	query := `
+	UPDATE share_links
+	SET
+		revoked_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND revoked_at IS NULL
+	`
+	_, err := c.exec(query, id)
+	return err
+}
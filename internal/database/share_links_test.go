@@ -0,0 +1,76 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClaimShareLinkPasswordAttempt(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		c := newTestClient(t, dsn)
+		user := createTestUser(t, c)
+		video := createTestVideo(t, c, user.ID)
+		password := "hash"
+		link, err := c.CreateShareLink(CreateShareLinkParams{
+			VideoID:   video.ID,
+			UserID:    user.ID,
+			TokenHash: "token-hash",
+			Password:  &password,
+			ExpiresAt: time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("CreateShareLink: %v", err)
+		}
+		now := time.Now()
+		lockedUntil := now.Add(time.Minute)
+
+		// Each step claims an attempt on the link as loaded at the
+		// previous step, or on a stale copy
+		steps := []struct {
+			name         string
+			stale        bool
+			lockedUntil  *time.Time
+			at           time.Time
+			wantClaimed  bool
+			wantAttempts int
+		}{
+			{name: "first attempt", at: now, wantClaimed: true, wantAttempts: 1},
+			{name: "attempt counted meanwhile", stale: true, at: now, wantClaimed: false, wantAttempts: 1},
+			{name: "attempt that locks", lockedUntil: &lockedUntil, at: now, wantClaimed: true, wantAttempts: 2},
+			{name: "attempt while locked", at: now.Add(time.Second), wantClaimed: false, wantAttempts: 2},
+			{name: "attempt after the lock", at: lockedUntil.Add(time.Second), wantClaimed: true, wantAttempts: 3},
+		}
+		loaded := link
+		for _, step := range steps {
+			claim := loaded
+			if step.stale {
+				claim = link
+			}
+			claimed, err := c.ClaimShareLinkPasswordAttempt(claim, step.lockedUntil, step.at)
+			if err != nil {
+				t.Fatalf("%s: ClaimShareLinkPasswordAttempt: %v", step.name, err)
+			}
+			if claimed != step.wantClaimed {
+				t.Errorf("%s: claimed = %v, want %v", step.name, claimed, step.wantClaimed)
+			}
+			loaded, err = c.GetShareLink(link.ID)
+			if err != nil {
+				t.Fatalf("%s: GetShareLink: %v", step.name, err)
+			}
+			if loaded.FailedPasswordAttempts != step.wantAttempts {
+				t.Errorf("%s: %d attempts, want %d", step.name, loaded.FailedPasswordAttempts, step.wantAttempts)
+			}
+		}
+
+		if err := c.ResetShareLinkPasswordFailures(link.ID); err != nil {
+			t.Fatalf("ResetShareLinkPasswordFailures: %v", err)
+		}
+		reset, err := c.GetShareLink(link.ID)
+		if err != nil {
+			t.Fatalf("GetShareLink: %v", err)
+		}
+		if reset.FailedPasswordAttempts != 0 || reset.PasswordLockedUntil != nil {
+			t.Errorf("reset link has %d attempts, locked until %v", reset.FailedPasswordAttempts, reset.PasswordLockedUntil)
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoUpload tracks a resumable upload in progress. The received bytes live
+// in the blob store, this row only records how far the client got.
+type VideoUpload struct {
+	ID           uuid.UUID `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	UploadOffset int64     `json:"upload_offset"`
+	// ChunkKeys are the blob store keys of the received chunks, in order
+	ChunkKeys []string `json:"-"`
+	CreateVideoUploadParams
+}
+
+type CreateVideoUploadParams struct {
+	VideoID      uuid.UUID `json:"video_id"`
+	UserID       uuid.UUID `json:"user_id"`
+	UploadLength int64     `json:"upload_length"`
+	ContentType  string    `json:"content_type"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+func (c Client) CreateVideoUpload(params CreateVideoUploadParams) (VideoUpload, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO video_uploads (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		content_type,
+		expires_at
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, 0, ?, ?)
+	`
+	_, err := c.exec(
+		query,
+		id,
+		params.VideoID,
+		params.UserID,
+		params.UploadLength,
+		params.ContentType,
+		params.ExpiresAt.UTC(),
+	)
+	if err != nil {
+		return VideoUpload{}, err
+	}
+
+	return c.GetVideoUpload(id)
+}
+
+func (c Client) GetVideoUpload(id uuid.UUID) (VideoUpload, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		chunk_keys,
+		content_type,
+		expires_at
+	FROM video_uploads
+	WHERE id = ?
+	`
+
+	upload, err := scanVideoUpload(c.queryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoUpload{}, nil
+		}
+		return VideoUpload{}, err
+	}
+	return upload, nil
+}
+
+// AdvanceVideoUploadOffset moves the offset from `from` to `to`, recording
+// chunkKey as the chunk holding the bytes in between, and pushes the expiry
+// out. It reports false if another request moved the offset first.
+func (c Client) AdvanceVideoUploadOffset(id uuid.UUID, from, to int64, chunkKey string, expiresAt time.Time) (bool, error) {
+	// Stored space separated, in the order they were received
+	query := `
+	UPDATE video_uploads
+	SET
+		upload_offset = ?,
+		chunk_keys = chunk_keys || ?,
+		expires_at = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND upload_offset = ?
+	`
+	result, err := c.exec(query, to, " "+chunkKey, expiresAt.UTC(), id, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (c Client) GetExpiredVideoUploads(now time.Time) ([]VideoUpload, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		chunk_keys,
+		content_type,
+		expires_at
+	FROM video_uploads
+	WHERE expires_at < ?
+	`
+
+	rows, err := c.query(query, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []VideoUpload{}
+	for rows.Next() {
+		upload, err := scanVideoUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+func (c Client) GetVideoUploadsForVideo(videoID uuid.UUID) ([]VideoUpload, error) {
+	return c.getVideoUploads(`WHERE video_id = ?`, videoID)
+}
+
+func (c Client) GetAllVideoUploads() ([]VideoUpload, error) {
+	return c.getVideoUploads(``)
+}
+
+func (c Client) getVideoUploads(where string, args ...any) ([]VideoUpload, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		chunk_keys,
+		content_type,
+		expires_at
+	FROM video_uploads
+	` + where
+
+	rows, err := c.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []VideoUpload{}
+	for rows.Next() {
+		upload, err := scanVideoUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+func (c Client) DeleteVideoUpload(id uuid.UUID) error {
+	query := `
+	DELETE FROM video_uploads
+	WHERE id = ?
+	`
+	_, err := c.exec(query, id)
+	return err
+}
+
+func scanVideoUpload(row rowScanner) (VideoUpload, error) {
+	var upload VideoUpload
+	var chunkKeys string
+	err := row.Scan(
+		&upload.ID,
+		&upload.CreatedAt,
+		&upload.UpdatedAt,
+		&upload.VideoID,
+		&upload.UserID,
+		&upload.UploadLength,
+		&upload.UploadOffset,
+		&chunkKeys,
+		&upload.ContentType,
+		&upload.ExpiresAt,
+	)
+	upload.ChunkKeys = strings.Fields(chunkKeys)
+	return upload, err
+}
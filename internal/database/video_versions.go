@@ -0,0 +1,244 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoVersion is a processed file a video has had. Versions are numbered
+// per video from 1, the current one is the version whose VideoURL the video
+// points at.
+type VideoVersion struct {
+	VideoID   uuid.UUID `json:"video_id"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    uuid.UUID `json:"user_id"`
+	VideoURL  string    `json:"video_url"`
+	HLSURL    *string   `json:"hls_url"`
+	DASHURL   *string   `json:"dash_url"`
+	VideoMetadata
+}
+
+const videoVersionColumns = `
+		video_id,
+		version,
+		created_at,
+		user_id,
+		video_url,
+		hls_url,
+		dash_url,
+		duration_seconds,
+		video_codec,
+		audio_codec,
+		bitrate,
+		frame_rate,
+		rotation,
+		audio_channel_layout`
+
+func scanVideoVersion(row rowScanner) (VideoVersion, error) {
+	var version VideoVersion
+	err := row.Scan(
+		&version.VideoID,
+		&version.Version,
+		&version.CreatedAt,
+		&version.UserID,
+		&version.VideoURL,
+		&version.HLSURL,
+		&version.DASHURL,
+		&version.DurationSeconds,
+		&version.VideoCodec,
+		&version.AudioCodec,
+		&version.Bitrate,
+		&version.FrameRate,
+		&version.Rotation,
+		&version.AudioChannelLayout,
+	)
+	return version, err
+}
+
+func scanVideoVersions(rows *sql.Rows) ([]VideoVersion, error) {
+	defer rows.Close()
+	versions := []VideoVersion{}
+	for rows.Next() {
+		version, err := scanVideoVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// GetVideoVersions returns the versions of a video, newest first.
+func (c Client) GetVideoVersions(videoID uuid.UUID) ([]VideoVersion, error) {
+	rows, err := c.query(`
+	SELECT`+videoVersionColumns+`
+	FROM video_versions
+	WHERE video_id = ?
+	ORDER BY version DESC
+	`, videoID)
+	if err != nil {
+		return nil, err
+	}
+	return scanVideoVersions(rows)
+}
+
+// GetAllVideoVersions returns every version of every video, for maintenance
+// tasks that need to know which blobs are in use.
+func (c Client) GetAllVideoVersions() ([]VideoVersion, error) {
+	rows, err := c.query(`
+	SELECT` + videoVersionColumns + `
+	FROM video_versions
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return scanVideoVersions(rows)
+}
+
+// addVideoVersion records the file video points at as its next version, then
+// removes the oldest versions beyond keep other than the current one and
+// returns them.
+func addVideoVersion(t tx, video Video, keep int) ([]VideoVersion, error) {
+	var next int
+	err := t.queryRow(`
+	SELECT COALESCE(MAX(version), 0) + 1
+	FROM video_versions
+	WHERE video_id = ?
+	`, video.ID).Scan(&next)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.exec(`
+	INSERT INTO video_versions (`+videoVersionColumns+`
+	) VALUES (?, ?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`,
+		video.ID,
+		next,
+		video.UserID,
+		video.VideoURL,
+		video.HLSURL,
+		video.DASHURL,
+		video.DurationSeconds,
+		video.VideoCodec,
+		video.AudioCodec,
+		video.Bitrate,
+		video.FrameRate,
+		video.Rotation,
+		video.AudioChannelLayout,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := t.query(`
+	SELECT`+videoVersionColumns+`
+	FROM video_versions
+	WHERE video_id = ?
+	ORDER BY version DESC
+	`, video.ID)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := scanVideoVersions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := []VideoVersion{}
+	kept := 0
+	for _, version := range versions {
+		if version.VideoURL == *video.VideoURL || kept < keep {
+			kept++
+			continue
+		}
+		_, err := t.exec(`DELETE FROM video_versions WHERE video_id = ? AND version = ?`, version.VideoID, version.Version)
+		if err != nil {
+			return nil, err
+		}
+		pruned = append(pruned, version)
+	}
+	return pruned, nil
+}
+
+// ErrVideoProcessing is returned when a video can't be changed because an
+// upload of it is still being processed.
+var ErrVideoProcessing = errors.New("video is being processed")
+
+// RestoreVideoVersion makes an earlier version the video's current file. It
+// returns a zero Video if the version doesn't exist, and ErrVideoProcessing
+// while an upload is pending, since that upload would replace the file once
+// it's done.
+//
+// The restore takes the next upload sequence number like an upload does, so
+// jobs of earlier uploads that are still around can't replace the file or
+// change the status. See ReplaceVideoFile.
+func (c Client) RestoreVideoVersion(videoID uuid.UUID, version int) (Video, error) {
+	err := c.inTx(func(t tx) error {
+		v, err := scanVideoVersion(t.queryRow(`
+		SELECT`+videoVersionColumns+`
+		FROM video_versions
+		WHERE video_id = ? AND version = ?
+		`, videoID, version))
+		if err != nil {
+			return err
+		}
+
+		result, err := t.exec(`
+		UPDATE videos
+		SET
+			video_url = ?,
+			hls_url = ?,
+			dash_url = ?,
+			duration_seconds = ?,
+			video_codec = ?,
+			audio_codec = ?,
+			bitrate = ?,
+			frame_rate = ?,
+			rotation = ?,
+			audio_channel_layout = ?,
+			status = ?,
+			upload_seq = upload_seq + 1,
+			file_seq = upload_seq + 1,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status NOT IN (?, ?)
+		`,
+			v.VideoURL,
+			v.HLSURL,
+			v.DASHURL,
+			v.DurationSeconds,
+			v.VideoCodec,
+			v.AudioCodec,
+			v.Bitrate,
+			v.FrameRate,
+			v.Rotation,
+			v.AudioChannelLayout,
+			VideoStatusReady,
+			videoID,
+			VideoStatusUploaded,
+			VideoStatusProcessing,
+		)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrVideoProcessing
+		}
+		return nil
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return Video{}, nil
+	}
+	if err != nil {
+		return Video{}, err
+	}
+	return c.GetVideo(videoID)
+}
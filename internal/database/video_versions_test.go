@@ -0,0 +1,166 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestVideoVersionRetention(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		c := newTestClient(t, dsn)
+		video := createTestVideo(t, c, createTestUser(t, c).ID)
+
+		var pruned []string
+		cleanup := func(versions []VideoVersion) CreateJobParams {
+			for _, version := range versions {
+				pruned = append(pruned, version.VideoURL)
+			}
+			return CreateJobParams{Type: "cleanup", Payload: len(versions), MaxAttempts: 1, RunAt: time.Now()}
+		}
+
+		// Each step uploads videoURL as the next file of the video
+		steps := []struct {
+			videoURL     string
+			keepVersions int
+			wantVersions []string
+			wantPruned   []string
+		}{
+			{
+				videoURL:     "videos/1.mp4",
+				keepVersions: 5,
+				wantVersions: []string{"videos/1.mp4"},
+			},
+			{
+				videoURL:     "videos/2.mp4",
+				keepVersions: 5,
+				wantVersions: []string{"videos/2.mp4", "videos/1.mp4"},
+			},
+			{
+				videoURL:     "videos/3.mp4",
+				keepVersions: 2,
+				wantVersions: []string{"videos/3.mp4", "videos/2.mp4"},
+				wantPruned:   []string{"videos/1.mp4"},
+			},
+			{
+				videoURL:     "videos/4.mp4",
+				keepVersions: 1,
+				wantVersions: []string{"videos/4.mp4"},
+				wantPruned:   []string{"videos/3.mp4", "videos/2.mp4"},
+			},
+		}
+		for i, step := range steps {
+			pruned = nil
+			queueTestUpload(t, c, video, step.videoURL)
+
+			file := video
+			file.VideoURL = &step.videoURL
+			_, err := c.ReplaceVideoFile(file, int64(i+1), step.keepVersions, cleanup)
+			if err != nil {
+				t.Fatalf("%s: ReplaceVideoFile: %v", step.videoURL, err)
+			}
+
+			versions, err := c.GetVideoVersions(video.ID)
+			if err != nil {
+				t.Fatalf("%s: GetVideoVersions: %v", step.videoURL, err)
+			}
+			versionURLs := []string{}
+			for _, version := range versions {
+				versionURLs = append(versionURLs, version.VideoURL)
+			}
+			if !slices.Equal(versionURLs, step.wantVersions) {
+				t.Errorf("%s: versions %v, want %v", step.videoURL, versionURLs, step.wantVersions)
+			}
+			if !slices.Equal(pruned, step.wantPruned) {
+				t.Errorf("%s: pruned %v, want %v", step.videoURL, pruned, step.wantPruned)
+			}
+		}
+
+		jobs, err := c.GetUnfinishedJobs("cleanup")
+		if err != nil {
+			t.Fatalf("GetUnfinishedJobs: %v", err)
+		}
+		if len(jobs) != 2 {
+			t.Errorf("queued %d cleanup jobs, want 2", len(jobs))
+		}
+	})
+}
+
+func TestRestoreVideoVersion(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		c := newTestClient(t, dsn)
+		video := createTestVideo(t, c, createTestUser(t, c).ID)
+
+		noCleanup := func([]VideoVersion) CreateJobParams {
+			t.Fatal("nothing should be pruned")
+			return CreateJobParams{}
+		}
+		// replace processes an upload, reporting whether it became the
+		// video's file
+		replace := func(seq int64, videoURL string) bool {
+			t.Helper()
+			file := video
+			file.VideoURL = &videoURL
+			replaced, err := c.ReplaceVideoFile(file, seq, 10, noCleanup)
+			if err != nil {
+				t.Fatalf("ReplaceVideoFile: %v", err)
+			}
+			return replaced
+		}
+		wantVideo := func(step, wantURL, wantStatus string) {
+			t.Helper()
+			got, err := c.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("%s: GetVideo: %v", step, err)
+			}
+			gotURL := ""
+			if got.VideoURL != nil {
+				gotURL = *got.VideoURL
+			}
+			if gotURL != wantURL || got.Status != wantStatus {
+				t.Errorf("%s: video is %q and %s, want %q and %s", step, gotURL, got.Status, wantURL, wantStatus)
+			}
+		}
+
+		replace(queueTestUpload(t, c, video, "uploads/1.mp4"), "videos/1.mp4")
+		replace(queueTestUpload(t, c, video, "uploads/2.mp4"), "videos/2.mp4")
+
+		restored, err := c.RestoreVideoVersion(video.ID, 10)
+		if err != nil || restored.ID != uuid.Nil {
+			t.Errorf("restoring a missing version = %v, %v, want a zero Video", restored.ID, err)
+		}
+
+		// An upload being processed would replace the restored file
+		pending := queueTestUpload(t, c, video, "uploads/3.mp4")
+		if _, err := c.RestoreVideoVersion(video.ID, 1); !errors.Is(err, ErrVideoProcessing) {
+			t.Errorf("restoring while an upload is pending = %v, want %v", err, ErrVideoProcessing)
+		}
+		wantVideo("restore while pending", "videos/2.mp4", VideoStatusUploaded)
+
+		// Once the upload failed, its job may still be retried after the
+		// restore, and must not undo it
+		if err := c.UpdateVideoStatusForUpload(video.ID, pending, VideoStatusFailed); err != nil {
+			t.Fatalf("UpdateVideoStatusForUpload: %v", err)
+		}
+		if _, err := c.RestoreVideoVersion(video.ID, 1); err != nil {
+			t.Fatalf("RestoreVideoVersion: %v", err)
+		}
+		wantVideo("restore", "videos/1.mp4", VideoStatusReady)
+
+		if err := c.UpdateVideoStatusForUpload(video.ID, pending, VideoStatusProcessing); err != nil {
+			t.Fatalf("UpdateVideoStatusForUpload: %v", err)
+		}
+		if replace(pending, "videos/3.mp4") {
+			t.Error("an upload queued before the restore replaced the restored file")
+		}
+		wantVideo("stale upload", "videos/1.mp4", VideoStatusReady)
+
+		if !replace(queueTestUpload(t, c, video, "uploads/4.mp4"), "videos/4.mp4") {
+			t.Error("an upload queued after the restore didn't replace the file")
+		}
+		wantVideo("new upload", "videos/4.mp4", VideoStatusReady)
+	})
+}
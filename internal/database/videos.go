@@ -2,30 +2,117 @@ package database
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// Video processing states. A video starts out created, becomes uploaded once
+// a file is received and is ready after the processing job finishes.
+const (
+	VideoStatusCreated    = "created"
+	VideoStatusUploaded   = "uploaded"
+	VideoStatusProcessing = "processing"
+	VideoStatusReady      = "ready"
+	VideoStatusFailed     = "failed"
+)
+
+// Video visibility levels. Private videos are only visible to their owner,
+// unlisted ones to anyone with the link and public ones are also listed.
+const (
+	VisibilityPrivate  = "private"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
+)
+
+func ValidVisibility(visibility string) bool {
+	switch visibility {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return true
+	}
+	return false
+}
+
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID              uuid.UUID  `json:"id"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	ThumbnailURL    *string    `json:"thumbnail_url"`
+	VideoURL        *string    `json:"video_url"`
+	HLSURL          *string    `json:"hls_url"`
+	DASHURL         *string    `json:"dash_url"`
+	Thumbnails      Thumbnails `json:"thumbnails"`
+	ThumbnailSource *string    `json:"-"`
+	Status          string     `json:"status"`
 	CreateVideoParams
+	VideoMetadata
+}
+
+// ThumbnailVariant is one size of a video's thumbnail, encoded as JPEG and
+// WebP.
+type ThumbnailVariant struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	JPEG   string `json:"jpeg"`
+	WebP   string `json:"webp"`
+}
+
+// Thumbnails holds the variants of a thumbnail keyed by width. It is stored
+// as JSON.
+type Thumbnails map[string]ThumbnailVariant
+
+func (t *Thumbnails) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*t = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("can't scan %T into Thumbnails", src)
+	}
+	return json.Unmarshal(data, t)
+}
+
+func (t Thumbnails) Value() (driver.Value, error) {
+	if len(t) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// VideoMetadata is what ffprobe reports about the processed file. The fields
+// are nil until the video has been processed or when the probe didn't
+// report them.
+type VideoMetadata struct {
+	DurationSeconds    *float64 `json:"duration_seconds"`
+	VideoCodec         *string  `json:"video_codec"`
+	AudioCodec         *string  `json:"audio_codec"`
+	Bitrate            *int64   `json:"bitrate"`
+	FrameRate          *float64 `json:"frame_rate"`
+	Rotation           *int     `json:"rotation"`
+	AudioChannelLayout *string  `json:"audio_channel_layout"`
 }
 
 type CreateVideoParams struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
+	Visibility  string    `json:"visibility"`
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
@@ -33,13 +120,112 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
+		thumbnails,
+		thumbnail_source,
+		hls_url,
+		dash_url,
+		status,
+		duration_seconds,
+		video_codec,
+		audio_codec,
+		bitrate,
+		frame_rate,
+		rotation,
+		audio_channel_layout,
+		visibility,
+		user_id`
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.Thumbnails,
+		&video.ThumbnailSource,
+		&video.HLSURL,
+		&video.DASHURL,
+		&video.Status,
+		&video.DurationSeconds,
+		&video.VideoCodec,
+		&video.AudioCodec,
+		&video.Bitrate,
+		&video.FrameRate,
+		&video.Rotation,
+		&video.AudioChannelLayout,
+		&video.Visibility,
+		&video.UserID,
+	)
+	return video, err
+}
+
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE user_id = ?
 	ORDER BY created_at DESC
 	`
 
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, nil
+}
+
+// GetAllVideos returns every video, for maintenance tasks that need to know
+// which blobs are in use.
+func (c Client) GetAllVideos() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	`
+
+	rows, err := c.query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+// GetPublicVideos returns a page of public videos, newest first.
+func (c Client) GetPublicVideos(limit, offset int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE visibility = ?
+	ORDER BY created_at DESC
+	LIMIT ? OFFSET ?
+	`
+
+	rows, err := c.query(query, VisibilityPublic, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -47,17 +233,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -75,10 +252,16 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
+		status,
+		visibility,
 		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	visibility := params.Visibility
+	if visibility == "" {
+		visibility = VisibilityPrivate
+	}
+	_, err := c.exec(query, id, params.Title, params.Description, VideoStatusCreated, visibility, params.UserID)
 	if err != nil {
 		return Video{}, err
 	}
@@ -88,29 +271,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.queryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -121,35 +287,190 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
-func (c Client) UpdateVideo(video Video) error {
+// UpdateVideoDetails sets the fields the owner edits. Like the other
+// updates it only writes its own columns, so it never undoes a file the
+// worker swapped in meanwhile.
+func (c Client) UpdateVideoDetails(id uuid.UUID, title, description, visibility string) error {
 	query := `
 	UPDATE videos
 	SET
 		title = ?,
 		description = ?,
-		thumbnail_url = ?,
-		video_url = ?,
-		user_id = ?
+		visibility = ?,
+		updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?
 	`
+	_, err := c.exec(query, title, description, visibility, id)
+	return err
+}
 
-	_, err := c.db.Exec(
-		query,
-		video.Title,
-		video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		video.UserID,
-		video.ID,
-	)
+// UpdateVideoThumbnails makes thumbnailURL and its variants the video's
+// thumbnail and returns the variants it replaced, for the caller to delete.
+func (c Client) UpdateVideoThumbnails(id uuid.UUID, thumbnailURL string, thumbnails Thumbnails, source *string) (Thumbnails, error) {
+	forUpdate := ""
+	if c.dialect == dialectPostgres {
+		forUpdate = "FOR UPDATE"
+	}
+
+	var previous Thumbnails
+	err := c.inTx(func(t tx) error {
+		err := t.queryRow(`SELECT thumbnails FROM videos WHERE id = ? `+forUpdate, id).Scan(&previous)
+		if err != nil {
+			return err
+		}
+		_, err = t.exec(`
+		UPDATE videos
+		SET
+			thumbnail_url = ?,
+			thumbnails = ?,
+			thumbnail_source = ?,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+		`, thumbnailURL, thumbnails, source, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+func (c Client) UpdateVideoStatus(id uuid.UUID, status string) error {
+	query := `
+	UPDATE videos
+	SET
+		status = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.exec(query, status, id)
+	return err
+}
+
+// UpdateVideoStatusForUpload sets the status only while uploadSeq is the
+// video's latest upload, so an upload that was superseded doesn't report on
+// the newer one.
+func (c Client) UpdateVideoStatusForUpload(id uuid.UUID, uploadSeq int64, status string) error {
+	query := `
+	UPDATE videos
+	SET
+		status = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND upload_seq = ?
+	`
+	_, err := c.exec(query, status, id, uploadSeq)
 	return err
 }
 
+// ReplaceVideoFile points the video at the processed file of upload
+// uploadSeq, unless a later upload got there first, and records the file as
+// a new version. Versions beyond keepVersions are removed and cleanup builds
+// a job for their files, queued in the same transaction. It reports whether
+// the file was replaced.
+//
+// Only the file, stream and metadata columns are written, so edits made
+// while the upload was processing are kept. The status becomes ready unless
+// a newer upload is still on its way.
+func (c Client) ReplaceVideoFile(video Video, uploadSeq int64, keepVersions int, cleanup func(pruned []VideoVersion) CreateJobParams) (bool, error) {
+	forUpdate := ""
+	if c.dialect == dialectPostgres {
+		forUpdate = "FOR UPDATE"
+	}
+
+	replaced := false
+	err := c.inTx(func(t tx) error {
+		// Lock the row so versions are numbered one at a time
+		var userID uuid.UUID
+		err := t.queryRow(`SELECT user_id FROM videos WHERE id = ? `+forUpdate, video.ID).Scan(&userID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return err
+		}
+
+		result, err := t.exec(`
+		UPDATE videos
+		SET
+			video_url = ?,
+			hls_url = ?,
+			dash_url = ?,
+			duration_seconds = ?,
+			video_codec = ?,
+			audio_codec = ?,
+			bitrate = ?,
+			frame_rate = ?,
+			rotation = ?,
+			audio_channel_layout = ?,
+			status = CASE WHEN upload_seq = ? THEN ? ELSE status END,
+			file_seq = ?,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND file_seq <= ?
+		`,
+			video.VideoURL,
+			video.HLSURL,
+			video.DASHURL,
+			video.DurationSeconds,
+			video.VideoCodec,
+			video.AudioCodec,
+			video.Bitrate,
+			video.FrameRate,
+			video.Rotation,
+			video.AudioChannelLayout,
+			uploadSeq,
+			VideoStatusReady,
+			uploadSeq,
+			video.ID,
+			uploadSeq,
+		)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil || n == 0 {
+			return err
+		}
+		replaced = true
+
+		pruned, err := addVideoVersion(t, video, keepVersions)
+		if err != nil || len(pruned) == 0 {
+			return err
+		}
+		_, err = createJob(t, cleanup(pruned))
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return replaced, nil
+}
+
+// SetDefaultThumbnail sets the thumbnail of a video that doesn't have one
+// yet. It reports whether the thumbnail was set, so a thumbnail the owner
+// picked in the meantime is never replaced.
+func (c Client) SetDefaultThumbnail(id uuid.UUID, thumbnailURL string, thumbnails Thumbnails, source string) (bool, error) {
+	query := `
+	UPDATE videos
+	SET
+		thumbnail_url = ?,
+		thumbnails = ?,
+		thumbnail_source = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND thumbnail_url IS NULL
+	`
+	result, err := c.exec(query, thumbnailURL, thumbnails, source, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
 func (c Client) DeleteVideo(id uuid.UUID) error {
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err := c.exec(query, id)
 	return err
 }
@@ -0,0 +1,90 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// queueTestUpload queues a processing job for the video and returns the
+// upload sequence number the upload took.
+func queueTestUpload(t *testing.T, c Client, video Video, dedupeKey string) int64 {
+	t.Helper()
+	var seq int64
+	_, err := c.CreateVideoJob(video.ID, VideoStatusUploaded, dedupeKey, func(uploadSeq int64) CreateJobParams {
+		seq = uploadSeq
+		return CreateJobParams{Type: "process", Payload: uploadSeq, MaxAttempts: 1, RunAt: time.Now()}
+	})
+	if err != nil {
+		t.Fatalf("CreateVideoJob: %v", err)
+	}
+	return seq
+}
+
+func TestReplaceVideoFile(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		c := newTestClient(t, dsn)
+		video := createTestVideo(t, c, createTestUser(t, c).ID)
+		queueTestUpload(t, c, video, "uploads/1.mp4")
+		queueTestUpload(t, c, video, "uploads/2.mp4")
+
+		// Each step replaces the file with the one of upload seq
+		steps := []struct {
+			name         string
+			seq          int64
+			videoURL     string
+			wantReplaced bool
+			wantURL      string
+			wantStatus   string
+		}{
+			{
+				name:         "older upload while a newer one is pending",
+				seq:          1,
+				videoURL:     "videos/1.mp4",
+				wantReplaced: true,
+				wantURL:      "videos/1.mp4",
+				wantStatus:   VideoStatusUploaded,
+			},
+			{
+				name:         "newest upload",
+				seq:          2,
+				videoURL:     "videos/2.mp4",
+				wantReplaced: true,
+				wantURL:      "videos/2.mp4",
+				wantStatus:   VideoStatusReady,
+			},
+			{
+				name:         "older upload finishing last",
+				seq:          1,
+				videoURL:     "videos/1-again.mp4",
+				wantReplaced: false,
+				wantURL:      "videos/2.mp4",
+				wantStatus:   VideoStatusReady,
+			},
+		}
+		for _, step := range steps {
+			file := video
+			file.VideoURL = &step.videoURL
+			replaced, err := c.ReplaceVideoFile(file, step.seq, 5, func([]VideoVersion) CreateJobParams {
+				t.Fatalf("%s: nothing should be pruned", step.name)
+				return CreateJobParams{}
+			})
+			if err != nil {
+				t.Fatalf("%s: ReplaceVideoFile: %v", step.name, err)
+			}
+			if replaced != step.wantReplaced {
+				t.Errorf("%s: replaced = %v, want %v", step.name, replaced, step.wantReplaced)
+			}
+
+			got, err := c.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("%s: GetVideo: %v", step.name, err)
+			}
+			if got.VideoURL == nil || *got.VideoURL != step.wantURL {
+				t.Errorf("%s: video URL %v, want %q", step.name, got.VideoURL, step.wantURL)
+			}
+			if got.Status != step.wantStatus {
+				t.Errorf("%s: status %q, want %q", step.name, got.Status, step.wantStatus)
+			}
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalStorePresignedPutSizeLimit(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir(), "http://localhost:8091/blobs", []byte("test-secret"), 10)
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	handler := http.StripPrefix("/blobs", store)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "within the limit", body: "0123456789", wantStatus: http.StatusOK},
+		{name: "over the limit", body: "0123456789a", wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := "uploads/" + strings.ReplaceAll(tt.name, " ", "-") + ".mp4"
+			url, err := store.PresignPut(context.Background(), key, "video/mp4", time.Minute)
+			if err != nil {
+				t.Fatalf("PresignPut: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPut, url, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+
+			_, err = store.Head(context.Background(), key)
+			if stored := err == nil; stored != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("stored = %v (%v)", stored, err)
+			}
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				t.Errorf("Head: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	minPartSize = 5 << 20
+	maxParts    = 10000
+)
+
+// S3Options tunes multipart uploads. Zero values fall back to the defaults.
+type S3Options struct {
+	// PartSize is the size of each part, objects larger than one part are
+	// uploaded in parts. S3 requires at least 5 MiB.
+	PartSize int64
+	// Concurrency is the number of parts uploaded at the same time.
+	Concurrency int
+	// PartRetries is how many times a failed part is retried. Unlike the
+	// other options 0 is a valid setting, nil falls back to the default.
+	PartRetries *int
+}
+
+const defaultPartRetries = 3
+
+var defaultS3Options = S3Options{
+	PartSize:    16 << 20,
+	Concurrency: 4,
+}
+
+func (o S3Options) withDefaults() S3Options {
+	if o.PartSize <= 0 {
+		o.PartSize = defaultS3Options.PartSize
+	}
+	if o.PartSize < minPartSize {
+		o.PartSize = minPartSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = defaultS3Options.Concurrency
+	}
+	if o.PartRetries == nil || *o.PartRetries < 0 {
+		partRetries := defaultPartRetries
+		o.PartRetries = &partRetries
+	}
+	return o
+}
+
+// sizedReaderAt reports the size of bodies that support random access, such
+// as *os.File, so they can be split into parts.
+func sizedReaderAt(body io.Reader) (io.ReaderAt, int64, bool) {
+	readerAt, ok := body.(io.ReaderAt)
+	if !ok {
+		return nil, 0, false
+	}
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return nil, 0, false
+	}
+	current, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, false
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, false
+	}
+	if _, err := seeker.Seek(current, io.SeekStart); err != nil {
+		return nil, 0, false
+	}
+	return io.NewSectionReader(readerAt, current, end-current), end - current, true
+}
+
+func (s *S3Store) putMultipart(ctx context.Context, key string, body io.ReaderAt, size int64, contentType string) error {
+	partSize := s.options.PartSize
+	if size/partSize >= maxParts {
+		partSize = size/maxParts + 1
+	}
+	numParts := int((size + partSize - 1) / partSize)
+
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:            &s.bucket,
+		Key:               &key,
+		ContentType:       &contentType,
+		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+	})
+	if err != nil {
+		return err
+	}
+	uploadID := created.UploadId
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parts := make([]types.CompletedPart, 0, numParts)
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, s.options.Concurrency)
+
+	for i := 0; i < numParts; i++ {
+		offset := int64(i) * partSize
+		length := min(partSize, size-offset)
+		partNumber := int32(i + 1)
+
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			part, err := s.uploadPart(ctx, key, uploadID, partNumber, io.NewSectionReader(body, offset, length))
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("part %d: %w", partNumber, err)
+					cancel()
+				}
+				return
+			}
+			parts = append(parts, part)
+		}()
+	}
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		s.abortMultipart(key, uploadID)
+		return firstErr
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.ToInt32(parts[i].PartNumber) < aws.ToInt32(parts[j].PartNumber)
+	})
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &s.bucket,
+		Key:             &key,
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		s.abortMultipart(key, uploadID)
+		return err
+	}
+	return nil
+}
+
+func (s *S3Store) uploadPart(ctx context.Context, key string, uploadID *string, partNumber int32, body *io.SectionReader) (types.CompletedPart, error) {
+	var err error
+	for attempt := 0; attempt <= *s.options.PartRetries; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(1<<(attempt-1)) * time.Second
+			select {
+			case <-ctx.Done():
+				return types.CompletedPart{}, ctx.Err()
+			case <-time.After(backoff):
+			}
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return types.CompletedPart{}, err
+			}
+		}
+
+		var out *s3.UploadPartOutput
+		out, err = s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:            &s.bucket,
+			Key:               &key,
+			UploadId:          uploadID,
+			PartNumber:        &partNumber,
+			Body:              body,
+			ContentLength:     aws.Int64(body.Size()),
+			ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+		})
+		if err == nil {
+			return types.CompletedPart{
+				PartNumber:    &partNumber,
+				ETag:          out.ETag,
+				ChecksumCRC32: out.ChecksumCRC32,
+			}, nil
+		}
+		if errors.Is(err, context.Canceled) {
+			break
+		}
+	}
+	return types.CompletedPart{}, err
+}
+
+// abortMultipart runs on its own context so a cancelled request still
+// cleans up the parts it already uploaded.
+func (s *S3Store) abortMultipart(key string, uploadID *string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &s.bucket,
+		Key:      &key,
+		UploadId: uploadID,
+	})
+	if err != nil {
+		log.Printf("Couldn't abort multipart upload of %q: %v", key, err)
+	}
+}
+
+// AbortStaleMultipartUploads aborts incomplete multipart uploads started more
+// than olderThan ago, which otherwise keep accruing storage charges.
+func (s *S3Store) AbortStaleMultipartUploads(ctx context.Context, olderThan time.Duration) (int, error) {
+	cutoff := time.Now().Add(-olderThan)
+	paginator := s3.NewListMultipartUploadsPaginator(s.client, &s3.ListMultipartUploadsInput{
+		Bucket: &s.bucket,
+	})
+
+	aborted := 0
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return aborted, err
+		}
+		for _, upload := range page.Uploads {
+			if aws.ToTime(upload.Initiated).After(cutoff) {
+				continue
+			}
+			_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   &s.bucket,
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				return aborted, err
+			}
+			aborted++
+		}
+	}
+	return aborted, nil
+}
+
+// SweepStaleMultipartUploads calls AbortStaleMultipartUploads every interval
+// until ctx is done.
+func (s *S3Store) SweepStaleMultipartUploads(ctx context.Context, interval, olderThan time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		aborted, err := s.AbortStaleMultipartUploads(ctx, olderThan)
+		if err != nil {
+			log.Printf("Couldn't sweep stale multipart uploads: %v", err)
+		} else if aborted > 0 {
+			log.Printf("Aborted %d stale multipart uploads in %q", aborted, s.bucket)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
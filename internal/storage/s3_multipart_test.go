@@ -0,0 +1,26 @@
+package storage
+
+import "testing"
+
+func TestS3OptionsPartRetries(t *testing.T) {
+	intPtr := func(n int) *int { return &n }
+
+	tests := []struct {
+		name        string
+		partRetries *int
+		want        int
+	}{
+		{name: "unset", partRetries: nil, want: defaultPartRetries},
+		{name: "no retries", partRetries: intPtr(0), want: 0},
+		{name: "set", partRetries: intPtr(5), want: 5},
+		{name: "negative", partRetries: intPtr(-1), want: defaultPartRetries},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := S3Options{PartRetries: tt.partRetries}.withDefaults()
+			if got.PartRetries == nil || *got.PartRetries != tt.want {
+				t.Errorf("PartRetries = %v, want %d", got.PartRetries, tt.want)
+			}
+		})
+	}
+}
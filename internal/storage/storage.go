@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("object not found")
+	ErrUnsupported = errors.New("operation not supported by this store")
+)
+
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// BlobStore is the storage backend for uploaded media. Keys are
+// slash-separated paths such as "landscape/abc123.mp4" and never include
+// the bucket or root directory.
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	Presign(ctx context.Context, key string, expiresIn time.Duration) (string, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// UploadPresigner is implemented by stores that can accept uploads straight
+// from clients so the bytes never pass through the API.
+type UploadPresigner interface {
+	PresignPut(ctx context.Context, key, contentType string, expiresIn time.Duration) (string, error)
+	PresignPost(ctx context.Context, key, contentType string, maxSize int64, expiresIn time.Duration) (PresignedPost, error)
+}
+
+// PresignedPost is an HTML form upload. Fields must be sent as form values
+// before the file itself.
+type PresignedPost struct {
+	URL    string            `json:"url"`
+	Fields map[string]string `json:"fields"`
+}
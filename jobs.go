@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Background work runs through the jobs table so it survives restarts and
+// can be shared by several API replicas. Workers poll for due jobs, retry
+// failures with exponential backoff and give up after MaxAttempts.
+
+const (
+	jobPollInterval = 2 * time.Second
+	jobLockDuration = 10 * time.Minute
+	jobMaxBackoff   = 10 * time.Minute
+
+	jobTypeProcessVideo     = "process_video"
+	jobTypeDeleteVideoBlobs = "delete_video_blobs"
+)
+
+type jobRunner struct {
+	run func(ctx context.Context, job database.Job) error
+	// failed runs once the job has used up all its attempts
+	failed func(ctx context.Context, job database.Job, err error)
+}
+
+func (cfg *apiConfig) jobRunners() map[string]jobRunner {
+	return map[string]jobRunner{
+		jobTypeProcessVideo: {
+			run:    cfg.runProcessVideoJob,
+			failed: cfg.failProcessVideoJob,
+		},
+		jobTypeDeleteVideoBlobs: {
+			run:    cfg.runDeleteVideoBlobsJob,
+			failed: cfg.failDeleteVideoBlobsJob,
+		},
+	}
+}
+
+func (cfg *apiConfig) startJobWorkers(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		go cfg.runJobWorker(ctx)
+	}
+}
+
+func (cfg *apiConfig) runJobWorker(ctx context.Context) {
+	runners := cfg.jobRunners()
+	for {
+		job, err := cfg.db.ClaimJob(time.Now(), jobLockDuration)
+		if err != nil {
+			log.Printf("Couldn't claim job: %v", err)
+		}
+		if err != nil || job.ID == uuid.Nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+		cfg.runJob(ctx, runners, job)
+	}
+}
+
+func (cfg *apiConfig) runJob(ctx context.Context, runners map[string]jobRunner, job database.Job) {
+	runner, ok := runners[job.Type]
+	if !ok {
+		log.Printf("Job %s has unknown type %q", job.ID, job.Type)
+		cfg.db.FailJob(job.ID, fmt.Sprintf("unknown job type %q", job.Type))
+		return
+	}
+
+	// A job that keeps killing its worker is reclaimed once its lock runs
+	// out, stop once it has used up its attempts
+	var err error
+	if job.Attempts > job.MaxAttempts {
+		err = errors.New("worker stopped before the job finished")
+	} else {
+		err = cfg.runWithLock(ctx, runner, job)
+	}
+
+	if err == nil {
+		if err := cfg.db.CompleteJob(job.ID); err != nil {
+			log.Printf("Couldn't complete job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	log.Printf("Job %s (%s) attempt %d/%d failed: %v", job.ID, job.Type, job.Attempts, job.MaxAttempts, err)
+	if job.Attempts < job.MaxAttempts {
+		backoff := min(time.Duration(1<<(job.Attempts-1))*10*time.Second, jobMaxBackoff)
+		if err := cfg.db.RetryJob(job.ID, err.Error(), time.Now().Add(backoff)); err != nil {
+			log.Printf("Couldn't reschedule job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	if err := cfg.db.FailJob(job.ID, err.Error()); err != nil {
+		log.Printf("Couldn't fail job %s: %v", job.ID, err)
+	}
+	if runner.failed != nil {
+		runner.failed(ctx, job, err)
+	}
+}
+
+// runWithLock runs the job while extending its lock in the background so
+// slow jobs like transcodes aren't picked up by a second worker.
+func (cfg *apiConfig) runWithLock(ctx context.Context, runner jobRunner, job database.Job) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(jobLockDuration / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := cfg.db.ExtendJobLock(job.ID, time.Now().Add(jobLockDuration)); err != nil {
+					log.Printf("Couldn't extend lock for job %s: %v", job.ID, err)
+				}
+			}
+		}
+	}()
+
+	return runner.run(ctx, job)
+}
+
+type processVideoPayload struct {
+	VideoID     uuid.UUID `json:"video_id"`
+	SourceKey   string    `json:"source_key"`
+	ContentType string    `json:"content_type"`
+	// UploadSeq orders uploads to the same video, the latest processed one
+	// wins
+	UploadSeq int64 `json:"upload_seq"`
+}
+
+// stagedUploadKey is where raw uploads wait in the blob store until a worker
+// processes them.
+func stagedUploadKey(videoID uuid.UUID, extension string) (string, error) {
+	name, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("uploads/staged/%s/%s.%s", videoID, name, extension), nil
+}
+
+// queueVideoProcessing marks the video as uploaded and queues the job that
+// turns the raw upload at sourceKey into the video's file.
+func (cfg *apiConfig) queueVideoProcessing(videoID uuid.UUID, sourceKey, contentType string) (database.Video, error) {
+	// Source keys are unique per upload, so completing the same upload
+	// twice queues it once
+	_, err := cfg.db.CreateVideoJob(videoID, database.VideoStatusUploaded, sourceKey, func(uploadSeq int64) database.CreateJobParams {
+		return database.CreateJobParams{
+			Type: jobTypeProcessVideo,
+			Payload: processVideoPayload{
+				VideoID:     videoID,
+				SourceKey:   sourceKey,
+				ContentType: contentType,
+				UploadSeq:   uploadSeq,
+			},
+			MaxAttempts: 5,
+		}
+	})
+	if err != nil {
+		return database.Video{}, err
+	}
+	return cfg.db.GetVideo(videoID)
+}
+
+func (cfg *apiConfig) runProcessVideoJob(ctx context.Context, job database.Job) error {
+	var payload processVideoPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	video, err := cfg.db.GetVideo(payload.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		// The video was deleted while the job was queued
+		return cfg.store.Delete(ctx, payload.SourceKey)
+	}
+
+	if err := cfg.db.UpdateVideoStatusForUpload(video.ID, payload.UploadSeq, database.VideoStatusProcessing); err != nil {
+		return err
+	}
+
+	extension, err := getVideoExtension(payload.ContentType)
+	if err != nil {
+		return err
+	}
+
+	videoFilePath, err := cfg.downloadBlob(ctx, payload.SourceKey)
+	if err != nil {
+		return fmt.Errorf("couldn't fetch upload: %w", err)
+	}
+	defer os.Remove(videoFilePath)
+
+	if _, err := cfg.processVideo(ctx, video, payload.UploadSeq, videoFilePath, extension, payload.ContentType); err != nil {
+		return err
+	}
+
+	return cfg.store.Delete(ctx, payload.SourceKey)
+}
+
+func (cfg *apiConfig) failProcessVideoJob(ctx context.Context, job database.Job, jobErr error) {
+	var payload processVideoPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		log.Printf("Couldn't decode payload of job %s: %v", job.ID, err)
+		return
+	}
+	if err := cfg.db.UpdateVideoStatusForUpload(payload.VideoID, payload.UploadSeq, database.VideoStatusFailed); err != nil {
+		log.Printf("Couldn't mark video %s as failed: %v", payload.VideoID, err)
+	}
+	if err := cfg.store.Delete(ctx, payload.SourceKey); err != nil {
+		log.Printf("Couldn't delete upload %s: %v", payload.SourceKey, err)
+	}
+}
@@ -2,86 +2,119 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/cloudfront"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
-	"github.com/google/uuid"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 )
 
 type apiConfig struct {
 	db               database.Client
 	jwtSecret        string
+	jwtKeys          *auth.JWTKeys
 	platform         string
 	filepathRoot     string
 	assetsRoot       string
-	s3Client         *s3.Client
+	store            storage.BlobStore
 	s3Bucket         string
 	s3Region         string
 	s3CfDistribution string
 	port             string
+	dashEnabled      bool
+	streamCookies    *streamCookies
+	// videoVersionRetention is how many versions of a video's file are kept
+	videoVersionRetention int
 }
 
+// dbVideoToSignedVideo signs the URLs of a video. Only call it once the
+// caller is known to be allowed to view the video, see canViewVideo.
 func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video, error) {
-	if video.VideoURL == nil || *video.VideoURL == "" {
-		// We don't have a video URL, nothing to sign so just return the video as is even if empty
-		return database.Video{}, nil
+	// Thumbnails are served by the API from a URL that doesn't change when
+	// the thumbnail does
+	if video.ThumbnailURL != nil {
+		thumbnailURL := cfg.signThumbnailURL(video, thumbnailPath(video.ID))
+		video.ThumbnailURL = &thumbnailURL
 	}
-
-	// VideoURL is stored in the database as bucket,key
-	// We need to split it and generate a signed URL for the key in the bucket
-	// Then we replace the VideoURL with the signed URL
-	// This way we don't store signed URLs in the database which will expire
-	// and we don't expose the S3 bucket publicly
-	// Instead we generate a short-lived signed URL on demand
-
-	// Split on first comma only, in case the key contains commas
-	// which is valid in S3 keys
-	bucketAndKey := strings.Split(*video.VideoURL, ",")
-	if len(bucketAndKey) < 2 {
-		return database.Video{}, fmt.Errorf("video URL %q is not in expected bucket,key format", *video.VideoURL)
+	if len(video.Thumbnails) > 0 {
+		thumbnails := database.Thumbnails{}
+		for size, variant := range video.Thumbnails {
+			variant.JPEG = cfg.signThumbnailURL(video, thumbnailVariantPath(video.ID, variant.Width, "jpeg"))
+			variant.WebP = cfg.signThumbnailURL(video, thumbnailVariantPath(video.ID, variant.Width, "webp"))
+			thumbnails[size] = variant
+		}
+		video.Thumbnails = thumbnails
 	}
 
-	bucket := bucketAndKey[0]
-	key := bucketAndKey[1]
-
-	if !strings.Contains(bucket, cfg.s3Bucket) {
-		return database.Video{}, fmt.Errorf("video URL bucket %q does not match configured S3 bucket %q", bucket, cfg.s3Bucket)
+	if video.VideoURL == nil || *video.VideoURL == "" {
+		// We don't have a video URL, nothing to sign so just return the video as is
+		return video, nil
 	}
 
-	signedURL, err := generatePresignedURL(cfg.s3Client, cfg.s3Bucket, key, 15*60*time.Second)
+	// VideoURL is stored in the database as the blob store key.
+	// We generate a short-lived signed URL for the key and replace the
+	// VideoURL with it. This way we don't store signed URLs in the database
+	// which will expire and we don't expose the bucket publicly.
+	key := videoStorageKey(*video.VideoURL)
+
+	signedURL, err := cfg.store.Presign(context.Background(), key, 15*60*time.Second)
 	if err != nil {
 		return database.Video{}, err
 	}
 
-	*video.VideoURL = signedURL
+	video.VideoURL = &signedURL
+	// HLSURL holds the key of the master playlist, hand out a signed stream
+	// URL that also covers the renditions and segments
+	video.HLSURL = cfg.signedStreamURL(video, "hls")
+	video.DASHURL = cfg.signedStreamURL(video, "dash")
 	return video, nil
 }
 
-type thumbnail struct {
-	data      []byte
-	mediaType string
+// videoStorageKey returns the blob store key for a stored VideoURL. Older rows
+// hold a full S3 URL, in which case the key is the URL path.
+func videoStorageKey(videoURL string) string {
+	if isAbsoluteURL(videoURL) {
+		u, _ := url.Parse(videoURL)
+		return strings.TrimPrefix(u.Path, "/")
+	}
+	return videoURL
 }
 
-var videoThumbnails = map[uuid.UUID]thumbnail{}
+func isAbsoluteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
 
 func main() {
 	godotenv.Load(".env")
 
-	pathToDB := os.Getenv("DB_PATH")
+	// DB_URL takes a postgres:// connection string, DB_PATH a SQLite file
+	pathToDB := os.Getenv("DB_URL")
+	if pathToDB == "" {
+		pathToDB = os.Getenv("DB_PATH")
+	}
 	if pathToDB == "" {
 		log.Fatal("DB_URL must be set")
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(pathToDB, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	db, err := database.NewClient(pathToDB)
 	if err != nil {
 		log.Fatalf("Couldn't connect to database: %v", err)
@@ -92,6 +125,20 @@ func main() {
 		log.Fatal("JWT_SECRET environment variable is not set")
 	}
 
+	// Access tokens are signed with HS256 and JWT_SECRET unless asymmetric
+	// keys are configured. JWT_SECRET still signs URLs either way.
+	jwtKeys := auth.NewHMACKeys(jwtSecret)
+	if jwtKeysFile := os.Getenv("JWT_KEYS_FILE"); jwtKeysFile != "" {
+		hmacSecret := ""
+		if os.Getenv("JWT_ACCEPT_HS256") == "true" {
+			hmacSecret = jwtSecret
+		}
+		jwtKeys, err = auth.LoadJWTKeys(jwtKeysFile, hmacSecret, time.Now())
+		if err != nil {
+			log.Fatalf("Couldn't load JWT keys: %v", err)
+		}
+	}
+
 	platform := os.Getenv("PLATFORM")
 	if platform == "" {
 		log.Fatal("PLATFORM environment variable is not set")
@@ -107,54 +154,174 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
-	}
-
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
-	}
-
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
-	}
-
 	port := os.Getenv("PORT")
 	if port == "" {
 		log.Fatal("PORT environment variable is not set")
 	}
 
-	s3Config, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+	// DASH output is opt-in, HLS is always produced
+	dashEnabled := os.Getenv("DASH_ENABLED") == "true"
 
-	if err != nil {
-		log.Fatalf("unable to load AWS config: %v", err)
+	videoVersionRetention := 5
+	if retention := os.Getenv("VIDEO_VERSION_RETENTION"); retention != "" {
+		videoVersionRetention, err = strconv.Atoi(retention)
+		if err != nil || videoVersionRetention < 1 {
+			log.Fatalf("VIDEO_VERSION_RETENTION must be a positive number: %q", retention)
+		}
 	}
 
-	s3Client := s3.NewFromConfig(s3Config)
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend == "" {
+		storageBackend = "s3"
+	}
 
-	// Make sure we have access to the bucket
-	_, err = s3Client.HeadBucket(context.Background(), &s3.HeadBucketInput{
-		Bucket: &s3Bucket,
-	})
+	var store storage.BlobStore
+	var localStore *storage.LocalStore
+	var s3Bucket, s3Region, s3CfDistribution string
+
+	switch storageBackend {
+	case "s3":
+		s3Bucket = os.Getenv("S3_BUCKET")
+		if s3Bucket == "" {
+			log.Fatal("S3_BUCKET environment variable is not set")
+		}
+
+		s3Region = os.Getenv("S3_REGION")
+		if s3Region == "" {
+			log.Fatal("S3_REGION environment variable is not set")
+		}
+
+		s3CfDistribution = os.Getenv("S3_CF_DISTRO")
+		if s3CfDistribution == "" {
+			log.Fatal("S3_CF_DISTRO environment variable is not set")
+		}
+
+		s3Config, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+		if err != nil {
+			log.Fatalf("unable to load AWS config: %v", err)
+		}
+
+		s3Client := s3.NewFromConfig(s3Config)
+
+		// Make sure we have access to the bucket
+		_, err = s3Client.HeadBucket(context.Background(), &s3.HeadBucketInput{
+			Bucket: &s3Bucket,
+		})
+		if err != nil {
+			log.Fatalf("unable to access S3 bucket %q, %v", s3Bucket, err)
+		}
+
+		s3Options := storage.S3Options{}
+		if partSizeMB := os.Getenv("S3_MULTIPART_PART_SIZE_MB"); partSizeMB != "" {
+			n, err := strconv.ParseInt(partSizeMB, 10, 64)
+			if err != nil {
+				log.Fatalf("S3_MULTIPART_PART_SIZE_MB must be a number: %v", err)
+			}
+			s3Options.PartSize = n << 20
+		}
+		if concurrency := os.Getenv("S3_MULTIPART_CONCURRENCY"); concurrency != "" {
+			n, err := strconv.Atoi(concurrency)
+			if err != nil {
+				log.Fatalf("S3_MULTIPART_CONCURRENCY must be a number: %v", err)
+			}
+			s3Options.Concurrency = n
+		}
+		if partRetries := os.Getenv("S3_MULTIPART_PART_RETRIES"); partRetries != "" {
+			n, err := strconv.Atoi(partRetries)
+			if err != nil || n < 0 {
+				log.Fatalf("S3_MULTIPART_PART_RETRIES must be 0 or a positive number: %q", partRetries)
+			}
+			s3Options.PartRetries = &n
+		}
+
+		s3Store := storage.NewS3Store(s3Client, s3Bucket, s3Options)
+		go s3Store.SweepStaleMultipartUploads(context.Background(), time.Hour, 24*time.Hour)
+		store = s3Store
+	case "local":
+		localStorageRoot := os.Getenv("LOCAL_STORAGE_ROOT")
+		if localStorageRoot == "" {
+			log.Fatal("LOCAL_STORAGE_ROOT environment variable is not set")
+		}
+
+		localStore, err = storage.NewLocalStore(localStorageRoot, "/blobs", []byte(jwtSecret), maxVideoUploadSize)
+		if err != nil {
+			log.Fatalf("Couldn't create local storage directory: %v", err)
+		}
+		store = localStore
+	default:
+		log.Fatalf("STORAGE_BACKEND %q is not supported, use \"s3\" or \"local\"", storageBackend)
+	}
 
-	if err != nil {
-		log.Fatalf("unable to access S3 bucket %q, %v", s3Bucket, err)
+	// URL_SIGNER picks who signs download URLs: the storage backend itself
+	// or CloudFront, so playback goes through the CDN
+	var cookies *streamCookies
+	switch urlSigner := os.Getenv("URL_SIGNER"); urlSigner {
+	case "", "storage":
+	case "cloudfront":
+		if storageBackend != "s3" {
+			log.Fatal("URL_SIGNER=cloudfront needs STORAGE_BACKEND=s3")
+		}
+
+		keyPairID := os.Getenv("CF_KEY_PAIR_ID")
+		if keyPairID == "" {
+			log.Fatal("CF_KEY_PAIR_ID environment variable is not set")
+		}
+		privateKeyPath := os.Getenv("CF_PRIVATE_KEY_PATH")
+		if privateKeyPath == "" {
+			log.Fatal("CF_PRIVATE_KEY_PATH environment variable is not set")
+		}
+		privateKeyPEM, err := os.ReadFile(privateKeyPath)
+		if err != nil {
+			log.Fatalf("Couldn't read CloudFront private key: %v", err)
+		}
+		privateKey, err := cloudfront.ParsePrivateKey(privateKeyPEM)
+		if err != nil {
+			log.Fatalf("Couldn't parse CloudFront private key: %v", err)
+		}
+
+		cfOptions := storage.CloudFrontOptions{
+			IPAddress: os.Getenv("CF_SIGNED_IP_RANGE"),
+		}
+		switch policy := os.Getenv("CF_POLICY"); policy {
+		case "", "canned":
+			if cfOptions.IPAddress != "" {
+				log.Fatal("CF_SIGNED_IP_RANGE needs CF_POLICY=custom")
+			}
+		case "custom":
+			cfOptions.CustomPolicy = true
+		default:
+			log.Fatalf("CF_POLICY %q is not supported, use \"canned\" or \"custom\"", policy)
+		}
+
+		cfStore := storage.NewCloudFrontStore(store, s3CfDistribution, cloudfront.NewSigner(keyPairID, privateKey), cfOptions)
+		store = cfStore
+
+		if os.Getenv("CF_SIGNED_COOKIES") == "true" {
+			cookies = &streamCookies{
+				store:        cfStore,
+				cookieDomain: os.Getenv("CF_COOKIE_DOMAIN"),
+			}
+		}
+	default:
+		log.Fatalf("URL_SIGNER %q is not supported, use \"storage\" or \"cloudfront\"", urlSigner)
 	}
 
 	cfg := apiConfig{
 		db:               db,
 		jwtSecret:        jwtSecret,
+		jwtKeys:          jwtKeys,
 		platform:         platform,
 		filepathRoot:     filepathRoot,
 		assetsRoot:       assetsRoot,
-		s3Client:         s3Client,
+		store:            store,
 		s3Bucket:         s3Bucket,
 		s3Region:         s3Region,
 		s3CfDistribution: s3CfDistribution,
 		port:             port,
+		dashEnabled:      dashEnabled,
+		streamCookies:    cookies,
+
+		videoVersionRetention: videoVersionRetention,
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -162,6 +329,32 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		if err := runGC(&cfg, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	gcInterval, gcOpts, err := gcOptionsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	jobWorkers := 2
+	if workers := os.Getenv("JOB_WORKERS"); workers != "" {
+		jobWorkers, err = strconv.Atoi(workers)
+		if err != nil {
+			log.Fatalf("JOB_WORKERS must be a number: %v", err)
+		}
+	}
+
+	cfg.startJobWorkers(context.Background(), jobWorkers)
+	go cfg.expireTusUploads(context.Background(), 15*time.Minute)
+	if gcInterval > 0 {
+		go cfg.collectGarbagePeriodically(context.Background(), gcInterval, gcOpts)
+	}
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
@@ -169,19 +362,52 @@ func main() {
 	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
 	mux.Handle("/assets/", cacheMiddleware(assetsHandler))
 
+	if localStore != nil {
+		mux.Handle("/blobs/", http.StripPrefix("/blobs", localStore))
+	}
+
+	mux.HandleFunc("GET /.well-known/jwks.json", cfg.handlerJWKS)
+
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
 
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
-
-	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
-	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
-	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
-	mux.HandleFunc("GET /api/thumbnails/{videoID}", cfg.handlerThumbnailGet)
-	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	// Authenticated routes get the user from the request context, API keys
+	// need the scope given and can't reach the routes with an empty one
+	mux.Handle("POST /api/api_keys", cfg.authMiddleware("", cfg.handlerAPIKeyCreate))
+	mux.Handle("GET /api/api_keys", cfg.authMiddleware("", cfg.handlerAPIKeysList))
+	mux.Handle("DELETE /api/api_keys/{keyID}", cfg.authMiddleware("", cfg.handlerAPIKeyRevoke))
+	mux.Handle("GET /api/sessions", cfg.authMiddleware("", cfg.handlerSessionsList))
+	mux.Handle("DELETE /api/sessions", cfg.authMiddleware("", cfg.handlerSessionsRevokeAll))
+	mux.Handle("DELETE /api/sessions/{sessionID}", cfg.authMiddleware("", cfg.handlerSessionRevoke))
+
+	mux.Handle("POST /api/videos", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerVideoMetaCreate))
+	mux.Handle("POST /api/thumbnail_upload/{videoID}", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerUploadThumbnail))
+	mux.Handle("POST /api/video_upload/{videoID}", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerUploadVideo))
+	mux.Handle("POST /api/video_upload/{videoID}/presign", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerDirectUploadPresign))
+	mux.Handle("POST /api/video_upload/{videoID}/complete", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerDirectUploadComplete))
+	mux.HandleFunc("OPTIONS /api/tus/videos/{videoID}", cfg.handlerTusOptions)
+	mux.Handle("POST /api/tus/videos/{videoID}", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerTusCreate))
+	mux.HandleFunc("OPTIONS /api/tus/uploads/{uploadID}", cfg.handlerTusOptions)
+	mux.Handle("HEAD /api/tus/uploads/{uploadID}", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerTusHead))
+	mux.Handle("PATCH /api/tus/uploads/{uploadID}", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerTusPatch))
+	mux.Handle("DELETE /api/tus/uploads/{uploadID}", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerTusDelete))
+	mux.Handle("GET /api/videos", cfg.authMiddleware(auth.ScopeVideosRead, cfg.handlerVideosRetrieve))
+	mux.Handle("GET /api/videos/{videoID}", cfg.optionalAuthMiddleware(auth.ScopeVideosRead, cfg.handlerVideoGet))
+	mux.Handle("PATCH /api/videos/{videoID}", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerVideoMetaUpdate))
+	mux.HandleFunc("GET /api/public/videos", cfg.handlerPublicVideosRetrieve)
+	mux.Handle("POST /api/videos/{videoID}/share_links", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerShareLinkCreate))
+	mux.Handle("GET /api/videos/{videoID}/share_links", cfg.authMiddleware(auth.ScopeVideosRead, cfg.handlerShareLinksList))
+	mux.Handle("DELETE /api/videos/{videoID}/share_links/{shareLinkID}", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerShareLinkRevoke))
+	mux.HandleFunc("GET /api/share/{token}", cfg.handlerShareGet)
+	mux.Handle("GET /api/videos/{videoID}/versions", cfg.authMiddleware(auth.ScopeVideosRead, cfg.handlerVideoVersionsList))
+	mux.Handle("POST /api/videos/{videoID}/versions/{version}/restore", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerVideoVersionRestore))
+	mux.HandleFunc("GET /api/videos/{videoID}/stream/{format}/{expires}/{signature}/{file...}", cfg.handlerStreamGet)
+	mux.Handle("GET /api/videos/{videoID}/thumbnail_candidates", cfg.authMiddleware(auth.ScopeVideosRead, cfg.handlerThumbnailCandidatesList))
+	mux.Handle("POST /api/videos/{videoID}/thumbnail_candidates/{candidate}/select", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerThumbnailCandidateSelect))
+	mux.Handle("GET /api/thumbnails/{videoID}", cfg.optionalAuthMiddleware(auth.ScopeVideosRead, cfg.handlerThumbnailGet))
+	mux.Handle("DELETE /api/videos/{videoID}", cfg.authMiddleware(auth.ScopeVideosWrite, cfg.handlerVideoMetaDelete))
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
 
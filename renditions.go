@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Streaming formats share one rendition ladder. Rungs taller than the source
+// are skipped so we never upscale.
+
+type videoRendition struct {
+	name         string
+	height       int
+	videoBitrate int // kbit/s
+	audioBitrate int // kbit/s
+}
+
+var renditionLadder = []videoRendition{
+	{name: "1080p", height: 1080, videoBitrate: 5000, audioBitrate: 128},
+	{name: "720p", height: 720, videoBitrate: 2800, audioBitrate: 128},
+	{name: "480p", height: 480, videoBitrate: 1400, audioBitrate: 96},
+	{name: "240p", height: 240, videoBitrate: 400, audioBitrate: 64},
+}
+
+// segmentSeconds is the target segment length for every format
+const segmentSeconds = 6
+
+// streamContentTypes covers the files ffmpeg writes for the streaming formats
+var streamContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".mpd":  "application/dash+xml",
+	".m4s":  "video/iso.segment",
+}
+
+// h264Levels are the H.264 levels a rendition may need, with the frame size
+// in macroblocks and the macroblocks per second each allows.
+var h264Levels = []struct {
+	level       int // level_idc, 31 for 3.1
+	maxFrameMBs int
+	maxMBPS     int
+}{
+	{21, 792, 19800},
+	{22, 1620, 20250},
+	{30, 1620, 40500},
+	{31, 3600, 108000},
+	{32, 5120, 216000},
+	{40, 8192, 245760},
+	{42, 8704, 522240},
+	{50, 22080, 589824},
+	{51, 36864, 983040},
+	{52, 36864, 2073600},
+}
+
+// defaultFrameRate is assumed for sources whose frame rate wasn't probed
+const defaultFrameRate = 30
+
+// h264Level returns the lowest H.264 level, as level_idc, that fits width x
+// height at frameRate.
+func h264Level(width, height int, frameRate float64) int {
+	if frameRate <= 0 {
+		frameRate = defaultFrameRate
+	}
+	frameMBs := ((width + 15) / 16) * ((height + 15) / 16)
+	mbps := frameMBs * int(math.Ceil(frameRate))
+	for _, l := range h264Levels {
+		if frameMBs <= l.maxFrameMBs && mbps <= l.maxMBPS {
+			return l.level
+		}
+	}
+	return h264Levels[len(h264Levels)-1].level
+}
+
+// renditionSize scales width x height so the short side is target, keeping
+// both dimensions even as libx264 requires.
+func renditionSize(width, height, target int) (int, int) {
+	even := func(n int) int { return (n + 1) / 2 * 2 }
+	if width >= height {
+		return even(width * target / height), even(target)
+	}
+	return even(target), even(height * target / width)
+}
+
+// videoRenditions picks the rungs of the ladder that fit the source. Sources
+// smaller than the lowest rung get a single rendition at their own size.
+func videoRenditions(width, height int) []videoRendition {
+	shortSide := min(width, height)
+	renditions := []videoRendition{}
+	for _, rendition := range renditionLadder {
+		if rendition.height <= shortSide {
+			renditions = append(renditions, rendition)
+		}
+	}
+	if len(renditions) == 0 {
+		lowest := renditionLadder[len(renditionLadder)-1]
+		lowest.name = fmt.Sprintf("%dp", shortSide)
+		lowest.height = shortSide
+		renditions = append(renditions, lowest)
+	}
+	return renditions
+}
+
+// uploadDir puts every file under dir into the blob store below prefix,
+// keeping the relative layout so playlists can reference their segments.
+func (cfg *apiConfig) uploadDir(ctx context.Context, dir, prefix string, contentTypes map[string]string) error {
+	return filepath.WalkDir(dir, func(filePath string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		contentType, ok := contentTypes[filepath.Ext(filePath)]
+		if !ok {
+			contentType = "application/octet-stream"
+		}
+		key := path.Join(prefix, filepath.ToSlash(rel))
+		if err := cfg.store.Put(ctx, key, f, contentType); err != nil {
+			return fmt.Errorf("couldn't upload %s: %w", key, err)
+		}
+		return nil
+	})
+}
+
+// lastLines keeps the tail of ffmpeg's output, which is where it reports
+// what went wrong.
+func lastLines(output []byte, n int) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
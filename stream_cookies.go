@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/cloudfront"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// With signed cookies a player fetches playlists and segments straight from
+// CloudFront. One cookie set covers every file under a stream's prefix, so
+// the playlists don't need rewriting. The cookies only reach CloudFront if
+// it is served from a subdomain of cookieDomain.
+type streamCookies struct {
+	store        *storage.CloudFrontStore
+	cookieDomain string
+}
+
+// setStreamCookies sets CloudFront cookies for the stream prefixes of video
+// and points the stream URLs of signedVideo at the distribution.
+func (cfg *apiConfig) setStreamCookies(w http.ResponseWriter, video database.Video, signedVideo *database.Video) error {
+	if cfg.streamCookies == nil {
+		return nil
+	}
+
+	expires := time.Now().Add(streamURLExpiry)
+	for _, format := range []string{"hls", "dash"} {
+		prefix, entry, ok := streamBaseKey(video, format)
+		if !ok {
+			continue
+		}
+
+		cookies, err := cfg.streamCookies.store.Signer().Cookies(cloudfront.Policy{
+			Resource: cfg.streamCookies.store.URL(prefix) + "/*",
+			Expires:  expires,
+		})
+		if err != nil {
+			return err
+		}
+		for _, cookie := range cookies {
+			cookie.Domain = cfg.streamCookies.cookieDomain
+			cookie.Path = "/" + prefix + "/"
+			cookie.Expires = expires
+			cookie.Secure = true
+			cookie.HttpOnly = true
+			cookie.SameSite = http.SameSiteNoneMode
+			http.SetCookie(w, cookie)
+		}
+
+		streamURL := cfg.streamCookies.store.URL(path.Join(prefix, entry))
+		switch format {
+		case "hls":
+			signedVideo.HLSURL = &streamURL
+		case "dash":
+			signedVideo.DASHURL = &streamURL
+		}
+	}
+	return nil
+}
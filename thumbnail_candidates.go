@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Candidate thumbnails are frames picked at scene changes, topped up with
+// evenly spaced frames for videos without many cuts. Black frames are
+// dropped and the frame with the most contrast becomes the default.
+
+const (
+	maxThumbnailCandidates = 6
+	// Frames darker than this average luma (0-255) count as black
+	blackFrameLuma = 20
+	sceneThreshold = 0.3
+)
+
+type thumbnailCandidate struct {
+	path     string
+	contrast float64
+}
+
+func thumbnailCandidatesPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("thumbnails/%s/candidates/", videoID)
+}
+
+// thumbnailCandidateKey names candidates after the upload they were taken
+// from, so a thumbnail picked from an earlier upload's candidates never
+// matches the current ones.
+func thumbnailCandidateKey(videoID uuid.UUID, uploadSeq int64, index int) string {
+	return fmt.Sprintf("%s%d-%d.jpg", thumbnailCandidatesPrefix(videoID), uploadSeq, index)
+}
+
+// generateThumbnailCandidates extracts candidate frames from upload uploadSeq
+// of the video at filePath, replaces the video's previous candidates with
+// them and returns the key of the best one.
+func (cfg *apiConfig) generateThumbnailCandidates(ctx context.Context, videoID uuid.UUID, uploadSeq int64, filePath string, durationSeconds float64) (string, error) {
+	outputDir, err := os.MkdirTemp("", "tubely-thumbnails-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(outputDir)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-y", "-i", filePath,
+		"-vf", fmt.Sprintf("select='gt(scene,%g)',scale='min(1280,iw)':-2", sceneThreshold),
+		"-fps_mode", "vfr",
+		"-frames:v", strconv.Itoa(maxThumbnailCandidates*2),
+		"-q:v", "3",
+		filepath.Join(outputDir, "scene_%03d.jpg"),
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("ffmpeg scene frames: %w: %s", err, lastLines(output, 5))
+	}
+
+	frames, err := filepath.Glob(filepath.Join(outputDir, "scene_*.jpg"))
+	if err != nil {
+		return "", err
+	}
+	candidates := keepLitFrames(frames)
+
+	// Not enough cuts, fill up with frames spread over the video
+	for i := 1; len(candidates) < maxThumbnailCandidates && i <= maxThumbnailCandidates; i++ {
+		at := durationSeconds * float64(i) / float64(maxThumbnailCandidates+1)
+		framePath := filepath.Join(outputDir, fmt.Sprintf("spread_%03d.jpg", i))
+		cmd := exec.CommandContext(ctx, "ffmpeg",
+			"-y", "-ss", strconv.FormatFloat(at, 'f', 3, 64), "-i", filePath,
+			"-frames:v", "1",
+			"-vf", "scale='min(1280,iw)':-2",
+			"-q:v", "3",
+			framePath,
+		)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("ffmpeg frame at %.3fs: %w: %s", at, err, lastLines(output, 5))
+		}
+		candidates = append(candidates, keepLitFrames([]string{framePath})...)
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no usable frames found")
+	}
+	if len(candidates) > maxThumbnailCandidates {
+		candidates = candidates[:maxThumbnailCandidates]
+	}
+
+	if err := cfg.deleteThumbnailCandidates(ctx, videoID); err != nil {
+		return "", err
+	}
+
+	best := 0
+	for i, candidate := range candidates {
+		f, err := os.Open(candidate.path)
+		if err != nil {
+			return "", err
+		}
+		key := thumbnailCandidateKey(videoID, uploadSeq, i)
+		err = cfg.store.Put(ctx, key, f, "image/jpeg")
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("couldn't upload %s: %w", key, err)
+		}
+		if candidate.contrast > candidates[best].contrast {
+			best = i
+		}
+	}
+	return thumbnailCandidateKey(videoID, uploadSeq, best), nil
+}
+
+func (cfg *apiConfig) deleteThumbnailCandidates(ctx context.Context, videoID uuid.UUID) error {
+	objects, err := cfg.store.List(ctx, thumbnailCandidatesPrefix(videoID))
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := cfg.store.Delete(ctx, object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listThumbnailCandidates returns the keys of the video's candidates in
+// order.
+func (cfg *apiConfig) listThumbnailCandidates(ctx context.Context, videoID uuid.UUID) ([]string, error) {
+	prefix := thumbnailCandidatesPrefix(videoID)
+	objects, err := cfg.store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return candidateIndex(prefix, keys[i]) < candidateIndex(prefix, keys[j])
+	})
+	return keys, nil
+}
+
+// candidateIndex returns the position of the candidate at key among its
+// upload's candidates. Older candidates aren't prefixed with the upload.
+func candidateIndex(prefix, key string) int {
+	name := strings.TrimSuffix(strings.TrimPrefix(key, prefix), path.Ext(key))
+	if _, after, found := strings.Cut(name, "-"); found {
+		name = after
+	}
+	index, err := strconv.Atoi(name)
+	if err != nil {
+		return math.MaxInt
+	}
+	return index
+}
+
+// keepLitFrames drops frames that are black or can't be decoded.
+func keepLitFrames(framePaths []string) []thumbnailCandidate {
+	candidates := []thumbnailCandidate{}
+	for _, framePath := range framePaths {
+		mean, stddev, err := frameLuma(framePath)
+		if err != nil || mean < blackFrameLuma {
+			continue
+		}
+		candidates = append(candidates, thumbnailCandidate{path: framePath, contrast: stddev})
+	}
+	return candidates
+}
+
+// frameLuma returns the mean and standard deviation of the luma of an image,
+// sampling every fourth pixel in both directions.
+func frameLuma(framePath string) (float64, float64, error) {
+	f, err := os.Open(framePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var sum, sumSquares, n float64
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += 4 {
+		for x := bounds.Min.X; x < bounds.Max.X; x += 4 {
+			r, g, b, _ := img.At(x, y).RGBA()
+			luma := (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+			sum += luma
+			sumSquares += luma * luma
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0, fmt.Errorf("empty image")
+	}
+	mean := sum / n
+	return mean, math.Sqrt(max(sumSquares/n-mean*mean, 0)), nil
+}
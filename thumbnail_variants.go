@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Thumbnails are decoded on the server and re-encoded into a few widths as
+// JPEG and WebP for srcset. Re-encoding drops EXIF and anything else the
+// uploaded file carried. WebP is encoded by ffmpeg since the standard
+// library can only encode JPEG and PNG.
+
+var thumbnailWidths = []int{160, 320, 640, 1280}
+
+const (
+	// thumbnailDefaultWidth is the variant used as the video's thumbnail_url
+	thumbnailDefaultWidth = 640
+	minThumbnailSide      = 16
+	maxThumbnailSide      = 8192
+	maxThumbnailPixels    = 40_000_000
+	thumbnailJPEGQuality  = 85
+	thumbnailWebPQuality  = 80
+)
+
+var errInvalidThumbnail = errors.New("invalid thumbnail")
+
+// decodeThumbnail checks the real format and dimensions of an uploaded image
+// before decoding it, and applies its EXIF orientation.
+func decodeThumbnail(data []byte) (image.Image, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidThumbnail, err)
+	}
+	if config.Width < minThumbnailSide || config.Height < minThumbnailSide ||
+		config.Width > maxThumbnailSide || config.Height > maxThumbnailSide ||
+		config.Width*config.Height > maxThumbnailPixels {
+		return nil, fmt.Errorf("%w: %dx%d is outside the allowed dimensions", errInvalidThumbnail, config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidThumbnail, err)
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+	return img, nil
+}
+
+// storeThumbnailVariants encodes img at each thumbnail width up to its own
+// and uploads the results under a fresh prefix, so cached URLs of earlier
+// thumbnails never show the new image.
+func (cfg *apiConfig) storeThumbnailVariants(ctx context.Context, videoID uuid.UUID, img image.Image) (database.Thumbnails, error) {
+	name, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	prefix := fmt.Sprintf("thumbnails/%s/%s/", videoID, name)
+
+	outputDir, err := os.MkdirTemp("", "tubely-thumbnail-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(outputDir)
+
+	bounds := img.Bounds()
+	widths := []int{}
+	for _, width := range thumbnailWidths {
+		if width <= bounds.Dx() {
+			widths = append(widths, width)
+		}
+	}
+	if len(widths) == 0 {
+		widths = append(widths, bounds.Dx())
+	}
+
+	thumbnails := database.Thumbnails{}
+	for _, width := range widths {
+		height := max(1, bounds.Dy()*width/bounds.Dx())
+
+		// Flatten transparency onto white, JPEG has no alpha
+		resized := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(resized, resized.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.CatmullRom.Scale(resized, resized.Bounds(), img, bounds, draw.Over, nil)
+
+		var jpegData bytes.Buffer
+		if err := jpeg.Encode(&jpegData, resized, &jpeg.Options{Quality: thumbnailJPEGQuality}); err != nil {
+			return nil, err
+		}
+		webpData, err := encodeWebP(ctx, outputDir, resized)
+		if err != nil {
+			return nil, err
+		}
+
+		variant := database.ThumbnailVariant{
+			Width:  width,
+			Height: height,
+			JPEG:   fmt.Sprintf("%s%d.jpg", prefix, width),
+			WebP:   fmt.Sprintf("%s%d.webp", prefix, width),
+		}
+		if err := cfg.store.Put(ctx, variant.JPEG, &jpegData, "image/jpeg"); err != nil {
+			return nil, err
+		}
+		if err := cfg.store.Put(ctx, variant.WebP, bytes.NewReader(webpData), "image/webp"); err != nil {
+			return nil, err
+		}
+		thumbnails[strconv.Itoa(width)] = variant
+	}
+	return thumbnails, nil
+}
+
+func encodeWebP(ctx context.Context, dir string, img image.Image) ([]byte, error) {
+	pngPath := filepath.Join(dir, "variant.png")
+	webpPath := filepath.Join(dir, "variant.webp")
+
+	f, err := os.Create(pngPath)
+	if err != nil {
+		return nil, err
+	}
+	err = png.Encode(f, img)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-y", "-i", pngPath,
+		"-c:v", "libwebp",
+		"-quality", strconv.Itoa(thumbnailWebPQuality),
+		"-map_metadata", "-1",
+		webpPath,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ffmpeg webp: %w: %s", err, lastLines(output, 5))
+	}
+	return os.ReadFile(webpPath)
+}
+
+// defaultThumbnailKey picks the variant used as the video's thumbnail_url.
+func defaultThumbnailKey(thumbnails database.Thumbnails) string {
+	if variant, ok := thumbnails[strconv.Itoa(thumbnailDefaultWidth)]; ok {
+		return variant.JPEG
+	}
+	best := database.ThumbnailVariant{}
+	for _, variant := range thumbnails {
+		if variant.Width > best.Width {
+			best = variant
+		}
+	}
+	return best.JPEG
+}
+
+func (cfg *apiConfig) deleteThumbnailVariants(ctx context.Context, thumbnails database.Thumbnails) error {
+	for _, variant := range thumbnails {
+		for _, key := range []string{variant.JPEG, variant.WebP} {
+			if err := cfg.store.Delete(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replaceThumbnail makes img the video's thumbnail and removes the variants
+// of the previous one. source is the candidate frame img came from, if any.
+// It returns the video as stored afterwards.
+func (cfg *apiConfig) replaceThumbnail(ctx context.Context, video database.Video, img image.Image, source *string) (database.Video, error) {
+	thumbnails, err := cfg.storeThumbnailVariants(ctx, video.ID, img)
+	if err != nil {
+		return database.Video{}, err
+	}
+
+	thumbnailKey := defaultThumbnailKey(thumbnails)
+	previous, err := cfg.db.UpdateVideoThumbnails(video.ID, thumbnailKey, thumbnails, source)
+	if err != nil {
+		cfg.deleteThumbnailVariants(ctx, thumbnails)
+		return database.Video{}, err
+	}
+
+	if err := cfg.deleteThumbnailVariants(ctx, previous); err != nil {
+		log.Printf("Couldn't delete previous thumbnail of video %s: %v", video.ID, err)
+	}
+	// The rest of the row may have changed while the variants were encoded
+	return cfg.db.GetVideo(video.ID)
+}
+
+// loadBlobImage decodes an image kept in the blob store.
+func (cfg *apiConfig) loadBlobImage(ctx context.Context, key string) (image.Image, error) {
+	body, _, err := cfg.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeThumbnail(data)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Deleting a video removes its row and queues a job in the same transaction
+// that deletes its blobs, so storage is cleaned up even if the blob store is
+// down at the time. Versions pruned when a new file is uploaded are cleaned
+// up by the same job. The job only deletes what the row pointed to when it was
+// deleted, and every step is safe to repeat on retries.
+
+const deleteVideoBlobsMaxAttempts = 10
+
+type deleteVideoBlobsPayload struct {
+	VideoID uuid.UUID `json:"video_id"`
+	// Keys are single objects, Prefixes end in a slash and cover every
+	// object below them
+	Keys     []string `json:"keys"`
+	Prefixes []string `json:"prefixes"`
+	// AssetFiles are paths in the assets directory
+	AssetFiles []string `json:"asset_files"`
+}
+
+// videoBlobs lists everything stored for a video: its file, the HLS and
+// DASH renditions, the thumbnail variants and candidates and the chunks of
+// unfinished resumable uploads.
+func (cfg *apiConfig) videoBlobs(video database.Video, uploads []database.VideoUpload) deleteVideoBlobsPayload {
+	payload := deleteVideoBlobsPayload{
+		VideoID:  video.ID,
+		Keys:     []string{},
+		Prefixes: []string{fmt.Sprintf("thumbnails/%s/", video.ID)},
+	}
+
+	file := videoFileBlobs(video)
+	payload.Keys = append(payload.Keys, file.Keys...)
+	payload.Prefixes = append(payload.Prefixes, file.Prefixes...)
+	for _, upload := range uploads {
+		payload.Prefixes = append(payload.Prefixes, tusChunkPrefix(upload.ID))
+	}
+	if video.ThumbnailURL != nil && isAbsoluteURL(*video.ThumbnailURL) {
+		if file, ok := cfg.assetPath(*video.ThumbnailURL); ok {
+			payload.AssetFiles = append(payload.AssetFiles, file)
+		}
+	}
+	return payload
+}
+
+// videoFileBlobs lists the blobs of the video's current file: the MP4 and
+// its HLS and DASH renditions.
+func videoFileBlobs(video database.Video) deleteVideoBlobsPayload {
+	payload := deleteVideoBlobsPayload{
+		VideoID:  video.ID,
+		Keys:     []string{},
+		Prefixes: []string{},
+	}
+	if video.VideoURL != nil && *video.VideoURL != "" {
+		payload.Keys = append(payload.Keys, videoStorageKey(*video.VideoURL))
+	}
+	for _, format := range []string{"hls", "dash"} {
+		if prefix, _, ok := streamBaseKey(video, format); ok {
+			payload.Prefixes = append(payload.Prefixes, prefix+"/")
+		}
+	}
+	return payload
+}
+
+// videoVersionBlobs lists the blobs of the files of the given versions.
+func videoVersionBlobs(videoID uuid.UUID, versions []database.VideoVersion) deleteVideoBlobsPayload {
+	payload := deleteVideoBlobsPayload{
+		VideoID:  videoID,
+		Keys:     []string{},
+		Prefixes: []string{},
+	}
+	for _, version := range versions {
+		file := videoFileBlobs(versionVideo(version))
+		payload.Keys = append(payload.Keys, file.Keys...)
+		payload.Prefixes = append(payload.Prefixes, file.Prefixes...)
+	}
+	return payload
+}
+
+// versionVideo returns the video as it was with the version's file, enough
+// to locate the file's blobs.
+func versionVideo(version database.VideoVersion) database.Video {
+	return database.Video{
+		ID:       version.VideoID,
+		VideoURL: &version.VideoURL,
+		HLSURL:   version.HLSURL,
+		DASHURL:  version.DASHURL,
+	}
+}
+
+// deleteVideo deletes the video's row and queues the deletion of its blobs.
+func (cfg *apiConfig) deleteVideo(video database.Video) error {
+	uploads, err := cfg.db.GetVideoUploadsForVideo(video.ID)
+	if err != nil {
+		return err
+	}
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		return err
+	}
+
+	payload := cfg.videoBlobs(video, uploads)
+	previous := videoVersionBlobs(video.ID, versions)
+	payload.Keys = append(payload.Keys, previous.Keys...)
+	payload.Prefixes = append(payload.Prefixes, previous.Prefixes...)
+	_, err = cfg.db.DeleteVideoWithJob(video.ID, database.CreateJobParams{
+		Type:        jobTypeDeleteVideoBlobs,
+		Payload:     payload,
+		MaxAttempts: deleteVideoBlobsMaxAttempts,
+	})
+	return err
+}
+
+func (cfg *apiConfig) runDeleteVideoBlobsJob(ctx context.Context, job database.Job) error {
+	var payload deleteVideoBlobsPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+	return cfg.deleteBlobs(ctx, payload)
+}
+
+func (cfg *apiConfig) deleteBlobs(ctx context.Context, payload deleteVideoBlobsPayload) error {
+	for _, prefix := range payload.Prefixes {
+		objects, err := cfg.store.List(ctx, prefix)
+		if err != nil {
+			return fmt.Errorf("couldn't list %s: %w", prefix, err)
+		}
+		for _, object := range objects {
+			if err := cfg.store.Delete(ctx, object.Key); err != nil {
+				return fmt.Errorf("couldn't delete %s: %w", object.Key, err)
+			}
+		}
+	}
+	for _, key := range payload.Keys {
+		if err := cfg.store.Delete(ctx, key); err != nil {
+			return fmt.Errorf("couldn't delete %s: %w", key, err)
+		}
+	}
+	for _, file := range payload.AssetFiles {
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg *apiConfig) failDeleteVideoBlobsJob(ctx context.Context, job database.Job, jobErr error) {
+	var payload deleteVideoBlobsPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		log.Printf("Couldn't decode payload of job %s: %v", job.ID, err)
+		return
+	}
+	log.Printf("Gave up deleting the blobs of video %s, keys %v and prefixes %v are left behind: %v",
+		payload.VideoID, payload.Keys, payload.Prefixes, jobErr)
+}
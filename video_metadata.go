@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// videoMetadata pulls the fields we keep on the video out of a probe. Values
+// ffprobe leaves out, or reports as "N/A", stay nil.
+func videoMetadata(info FFProbeVideoInfo) database.VideoMetadata {
+	metadata := database.VideoMetadata{}
+
+	if duration, err := strconv.ParseFloat(info.Format.Duration, 64); err == nil {
+		metadata.DurationSeconds = &duration
+	}
+	if bitrate, err := strconv.ParseInt(info.Format.BitRate, 10, 64); err == nil {
+		metadata.Bitrate = &bitrate
+	}
+
+	videoStream := info.Streams[info.videoStreamIndex()]
+	metadata.VideoCodec = nonEmpty(videoStream.CodecName)
+	if fps, ok := parseFrameRate(videoStream.AvgFrameRate); ok {
+		metadata.FrameRate = &fps
+	} else if fps, ok := parseFrameRate(videoStream.RFrameRate); ok {
+		metadata.FrameRate = &fps
+	}
+	// Fall back to the stream's bitrate for containers that don't report one
+	if bitrate, err := strconv.ParseInt(videoStream.BitRate, 10, 64); err == nil && metadata.Bitrate == nil {
+		metadata.Bitrate = &bitrate
+	}
+	rotation := streamRotation(videoStream.Tags.Rotate, videoStream.SideDataList)
+	metadata.Rotation = &rotation
+
+	for _, stream := range info.Streams {
+		if stream.CodecType != "audio" {
+			continue
+		}
+		metadata.AudioCodec = nonEmpty(stream.CodecName)
+		layout := stream.ChannelLayout
+		if layout == "" && stream.Channels > 0 {
+			layout = strconv.Itoa(stream.Channels) + " channels"
+		}
+		metadata.AudioChannelLayout = nonEmpty(layout)
+		break
+	}
+	return metadata
+}
+
+// parseFrameRate parses ffprobe's rational frame rates like "30000/1001".
+// Unknown rates are reported as "0/0".
+func parseFrameRate(rate string) (float64, bool) {
+	num, den, ok := strings.Cut(rate, "/")
+	if !ok {
+		den = "1"
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, false
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 || n == 0 {
+		return 0, false
+	}
+	return math.Round(n/d*1000) / 1000, true
+}
+
+// streamRotation returns the clockwise rotation players apply to the stream,
+// normalized to 0, 90, 180 or 270. Newer ffprobe versions report it as a
+// display matrix, which rotates counterclockwise, older ones as a tag.
+func streamRotation(rotateTag string, sideData []FFProbeSideData) int {
+	rotation := 0
+	for _, data := range sideData {
+		if data.SideDataType == "Display Matrix" {
+			rotation = -int(math.Round(data.Rotation))
+		}
+	}
+	if rotation == 0 && rotateTag != "" {
+		rotation, _ = strconv.Atoi(rotateTag)
+	}
+	return ((rotation % 360) + 360) % 360
+}
+
+// displaySize returns the dimensions the video is shown at, swapping width
+// and height for videos rotated by a quarter turn.
+func displaySize(width, height, rotation int) (int, int) {
+	if rotation == 90 || rotation == 270 {
+		return height, width
+	}
+	return width, height
+}
+
+func nonEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}